@@ -10,16 +10,27 @@ type ValueNode struct {
 
 type VarNode struct {
 	Name string
+	Pos  Pos
 }
 
 type CallNode struct {
-	Name string
-	Args []Node
+	Name   string
+	Args   []Node
+	Pos    Pos
+	Method bool // x.name(...), Args[0] is x
+}
+
+// NamedArgsNode holds the arguments of a call passed as name => value. It
+// is the last of the call arguments.
+type NamedArgsNode struct {
+	Names  []string
+	Values []Node
 }
 
 type DynCallNode struct {
 	Value Node
 	Args  []Node
+	Pos   Pos
 }
 
 type CompoundNode struct {
@@ -27,12 +38,53 @@ type CompoundNode struct {
 }
 
 type AttrNode struct {
+	Expr     Node
+	Name     string
+	Pos      Pos
+	Optional bool // a?.name, a missing key is nil
+}
+
+// OptionalChainNode is a postfix chain with optional accesses like
+// a?.b.c(). The chain evaluates to nil if the receiver of an OptionalNode
+// in it is nil.
+type OptionalChainNode struct {
 	Expr Node
-	Name string
+}
+
+// OptionalNode is the receiver of an optional access (a in a?.b).
+type OptionalNode struct {
+	Expr Node
+}
+
+type CoalesceNode struct {
+	Exprs []Node
+}
+
+type IndexNode struct {
+	Expr  Node
+	Index Node
+	Pos   Pos
+}
+
+// SliceNode is Expr[Low:High], Low and High are nil if omitted.
+type SliceNode struct {
+	Expr Node
+	Low  Node
+	High Node
+	Pos  Pos
+}
+
+// Params are the parameters of a block or lambda besides the names of the
+// positional arguments.
+type Params struct {
+	Defaults []Node // default values of the last len(Defaults) arguments
+	Rest     string // ...rest collects the extra positional arguments
+	Kwargs   string // **kwargs collects the extra named arguments
 }
 
 type SubprogNode struct {
 	Args []string
+	Params
 	Prog Node
 }
 
@@ -40,6 +92,7 @@ type CompareNode struct {
 	Compare int
 	Left    Node
 	Right   Node
+	Pos     Pos
 }
 
 type AndNode struct {
@@ -53,6 +106,7 @@ type OrNode struct {
 type BinaryOP struct {
 	Op   int
 	Expr Node
+	Pos  Pos
 }
 
 type BinaryOPNode struct {
@@ -60,6 +114,15 @@ type BinaryOPNode struct {
 	Ops  []BinaryOP
 }
 
+type NotNode struct {
+	Expr Node
+}
+
+type NegNode struct {
+	Expr Node
+	Pos  Pos
+}
+
 type NumberNode struct {
 	Value string
 }
@@ -67,6 +130,7 @@ type NumberNode struct {
 type BlockNode struct {
 	Name string
 	Args []string
+	Params
 	Body []Node
 }
 
@@ -85,23 +149,75 @@ type DeclareNode struct {
 	Value Node
 }
 
+type AssignNode struct {
+	Name  string
+	Value Node
+	Pos   Pos
+}
+
 type ForNode struct {
 	Var  string
+	Vars []string // destructuring targets, for a, b in ...; overrides Var
 	Expr Node
 	Body []Node
+	Alt  []Node // runs if the iterable is empty
+	Pos  Pos
+}
+
+type WhileNode struct {
+	Cond Node
+	Body []Node
+	Pos  Pos
+}
+
+// TryNode renders Body and, if it fails, Catch instead with the error
+// object declared as Var. Catch is empty without a catch branch.
+type TryNode struct {
+	Body  []Node
+	Var   string
+	Catch []Node
+	Pos   Pos
+}
+
+type BreakNode struct{}
+
+type ContinueNode struct{}
+
+type ReturnNode struct {
+	Value Node
+	Pos   Pos
 }
 
 type IncludeNode struct {
 	Name Node
+	Pos  Pos
 }
 
 type DiscardNode struct {
 	Body []Node
 }
 
+// ImportNode declares the variables declared at the top level of the
+// template Name as an object As, or the ones in Names on their own.
+type ImportNode struct {
+	Name  Node
+	As    string
+	Names []string
+	Pos   Pos
+}
+
+// ExtendsNode makes the template render Template after it, with the
+// blocks declared at the top level of the template overriding the ones of
+// the parent.
+type ExtendsNode struct {
+	Template string
+	Pos      Pos
+}
+
 type ObjectKey struct {
-	Key   string
-	Value Node
+	Key     string
+	KeyExpr Node // computed key, used instead of Key if not nil
+	Value   Node
 }
 
 type ObjectNode struct {
@@ -109,6 +225,10 @@ type ObjectNode struct {
 	Keys   []ObjectKey
 }
 
+type ListNode struct {
+	Items []Node
+}
+
 type SingleValueNode struct {
 	Node Node
 }
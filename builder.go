@@ -1,12 +1,17 @@
 package tplexpr
 
-import "io/fs"
+import (
+	"bytes"
+	"io/fs"
+)
 
 type StoreBuilder struct {
 	plugins    []Plugin
 	files      []storeFS
+	bundles    [][]byte
 	watch      bool
 	noBuiltins bool
+	limits     Limits
 }
 
 type storeFS struct {
@@ -33,6 +38,12 @@ func (s *StoreBuilder) AddFS(fsys fs.FS, globs ...string) *StoreBuilder {
 	return s
 }
 
+// AddBundle adds the templates of a bundle written by WriteBundle.
+func (s *StoreBuilder) AddBundle(data []byte) *StoreBuilder {
+	s.bundles = append(s.bundles, data)
+	return s
+}
+
 func (s *StoreBuilder) Watch(watch bool) *StoreBuilder {
 	s.watch = watch
 	return s
@@ -43,6 +54,12 @@ func (s *StoreBuilder) AddBuiltins(addBuiltins bool) *StoreBuilder {
 	return s
 }
 
+// Limits sets the resource limits for every render of the store.
+func (s *StoreBuilder) Limits(limits Limits) *StoreBuilder {
+	s.limits = limits
+	return s
+}
+
 func (s *StoreBuilder) compileTemplate(name string, data []byte, cc *CompileContext) error {
 	for _, p := range s.plugins {
 		ok, err := p.ParseTemplate(name, data, cc)
@@ -62,11 +79,19 @@ func (s *StoreBuilder) Build() (Store, error) {
 		return &watchStore{
 			plugins:     s.plugins,
 			files:       s.files,
+			bundles:     s.bundles,
 			addBuiltins: !s.noBuiltins,
+			limits:      s.limits,
 		}, nil
 	}
 
 	cc := NewCompileContext()
+	for _, data := range s.bundles {
+		err := LoadBundle(bytes.NewReader(data), &cc)
+		if err != nil {
+			return nil, err
+		}
+	}
 	for i := range s.files {
 		f := &s.files[i]
 		for _, g := range f.globs {
@@ -81,12 +106,16 @@ func (s *StoreBuilder) Build() (Store, error) {
 				}
 				err = s.compileTemplate(fileName, data, &cc)
 				if err != nil {
-					return nil, err
+					return nil, setTemplateName(err, fileName)
 				}
 			}
 		}
 	}
 
+	err := cc.Link()
+	if err != nil {
+		return nil, err
+	}
 	_, c := cc.Compile()
 	if !s.noBuiltins {
 		AddBuiltins(&c)
@@ -94,5 +123,6 @@ func (s *StoreBuilder) Build() (Store, error) {
 	for _, p := range s.plugins {
 		p.InitContext(&c)
 	}
-	return &simpleStore{c}, nil
+	c.Limits = s.limits
+	return &simpleStore{newContextPool(&c)}, nil
 }
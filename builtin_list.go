@@ -30,9 +30,10 @@ var (
 )
 
 type mapIter struct {
-	src ValueIter
-	fn  Value
-	idx int
+	src  ValueIter
+	fn   Value
+	idx  int
+	args Args
 }
 
 var _ ValueIter = &mapIter{}
@@ -40,24 +41,25 @@ var _ ValueIter = &mapIter{}
 func (i *mapIter) Next() (Value, error) {
 	v, err := i.src.Next()
 	if err == nil {
-		v, err = Call(i.fn, []Value{v, NumberValue(i.idx)})
+		v, err = i.args.Call(i.fn, v, NumberValue(i.idx))
 		i.idx += 1
 	}
 	return v, err
 }
 
 func BuiltinMap(args Args) (Value, error) {
-	values, err := args.Get(0).Iter()
+	values, err := args.Iter(0)
 	if err != nil {
 		return nil, err
 	}
 	fn := args.GetDefault(1, mapSelf)
-	return IterValue{&mapIter{src: values, fn: fn}}, nil
+	return IterValue{&mapIter{src: values, fn: fn, args: args}}, nil
 }
 
 type filterIter struct {
-	src ValueIter
-	fn  Value
+	src  ValueIter
+	fn   Value
+	args Args
 }
 
 var _ ValueIter = &filterIter{}
@@ -69,7 +71,7 @@ func (i *filterIter) Next() (Value, error) {
 			return nil, err
 		}
 
-		ok, err := Call(i.fn, []Value{v})
+		ok, err := i.args.Call(i.fn, v)
 		if err != nil {
 			return nil, err
 		}
@@ -81,17 +83,17 @@ func (i *filterIter) Next() (Value, error) {
 }
 
 func BuiltinFilter(args Args) (Value, error) {
-	values, err := args.Get(0).Iter()
+	values, err := args.Iter(0)
 	if err != nil {
 		return nil, err
 	}
 	fn := args.GetDefault(1, filterAny)
 
-	return IterValue{&filterIter{src: values, fn: fn}}, nil
+	return IterValue{&filterIter{src: values, fn: fn, args: args}}, nil
 }
 
 func BuiltinReversed(args Args) (Value, error) {
-	lst, err := args.Get(0).List()
+	lst, err := args.List(0)
 	if err != nil {
 		return nil, err
 	}
@@ -103,7 +105,7 @@ func BuiltinReversed(args Args) (Value, error) {
 }
 
 func BuiltinJoin(args Args) (Value, error) {
-	value, err := args.Get(0).List()
+	value, err := args.List(0)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +123,9 @@ func BuiltinJoin(args Args) (Value, error) {
 		if err != nil {
 			return nil, err
 		}
+		if err := args.exec.checkStringSize(sb.Len() + len(str)); err != nil {
+			return nil, err
+		}
 		sb.WriteString(str)
 	}
 
@@ -128,10 +133,13 @@ func BuiltinJoin(args Args) (Value, error) {
 }
 
 func BuiltinAppend(args Args) (Value, error) {
-	lst, err := args.Get(0).List()
+	lst, err := args.List(0)
 	if err != nil {
 		return nil, err
 	}
+	if err := args.exec.checkListSize(len(lst) + args.Len() - 1); err != nil {
+		return nil, err
+	}
 	clone := make(ListValue, 0, len(lst)+args.Len()-1)
 	clone = append(clone, lst...)
 	for i := 1; i < args.Len(); i++ {
@@ -141,15 +149,18 @@ func BuiltinAppend(args Args) (Value, error) {
 }
 
 func BuiltinExtend(args Args) (Value, error) {
-	lst, err := args.Get(0).List()
+	lst, err := args.List(0)
 	if err != nil {
 		return nil, err
 	}
-	lst2, err := args.Get(1).List()
+	lst2, err := args.List(1)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := args.exec.checkListSize(len(lst) + len(lst2)); err != nil {
+		return nil, err
+	}
 	clone := make(ListValue, 0, len(lst)+len(lst2))
 	clone = append(clone, lst...)
 	clone = append(clone, lst2...)
@@ -182,7 +193,7 @@ func (s *sortableList) Swap(i, j int) {
 }
 
 func BuiltinSorted(args Args) (Value, error) {
-	lst, err := args.Get(0).List()
+	lst, err := args.List(0)
 	if err != nil {
 		return nil, err
 	}
@@ -232,7 +243,7 @@ func reduceArgs(args Args, fn func(Value, Value) (Value, error)) (v Value, err e
 	case 0:
 		return Nil, nil
 	case 1:
-		values, err = args.Get(0).Iter()
+		values, err = args.Iter(0)
 		if err != nil {
 			return
 		}
@@ -282,7 +293,7 @@ func BuiltinMin(args Args) (v Value, err error) {
 }
 
 func BuiltinReduce(args Args) (v Value, err error) {
-	values, err := args.Get(0).Iter()
+	values, err := args.Iter(0)
 	if err != nil {
 		return nil, err
 	}
@@ -290,6 +301,6 @@ func BuiltinReduce(args Args) (v Value, err error) {
 	fn := args.Get(1)
 
 	return reduceIter(values, func(v1, v2 Value) (Value, error) {
-		return Call(fn, []Value{v1, v2})
+		return args.Call(fn, v1, v2)
 	})
 }
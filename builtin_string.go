@@ -18,7 +18,45 @@ func BuiltinLower(args Args) (Value, error) {
 	return StringValue(strings.ToLower(s)), nil
 }
 
+func BuiltinTrim(args Args) (Value, error) {
+	s, err := args.Get(0).String()
+	if err != nil {
+		return nil, err
+	}
+	return StringValue(strings.TrimSpace(s)), nil
+}
+
+// BuiltinTruncate shortens a string to at most n runes, the last of them
+// are replaced by end (default "...") if the string is truncated.
+func BuiltinTruncate(args Args) (Value, error) {
+	s, err := args.Get(0).String()
+	if err != nil {
+		return nil, err
+	}
+	n, err := args.Get(1).Number()
+	if err != nil {
+		return nil, err
+	}
+	end, err := args.GetDefault(2, StringValue("...")).String()
+	if err != nil {
+		return nil, err
+	}
+
+	runes := []rune(s)
+	length := max(int(n), 0)
+	if len(runes) <= length {
+		return StringValue(s), nil
+	}
+	endRunes := []rune(end)
+	if len(endRunes) > length {
+		return StringValue(runes[:length]), nil
+	}
+	return StringValue(string(runes[:length-len(endRunes)]) + end), nil
+}
+
 func AddStringBuiltins(c *Context) {
 	c.Declare("upper", FuncValue(BuiltinUpper))
 	c.Declare("lower", FuncValue(BuiltinLower))
+	c.Declare("trim", FuncValue(BuiltinTrim))
+	c.Declare("truncate", FuncValue(BuiltinTruncate))
 }
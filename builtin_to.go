@@ -16,7 +16,7 @@ func BuiltinToString(args Args) (Value, error) {
 }
 
 func BuiltinToList(args Args) (Value, error) {
-	l, err := args.Get(0).List()
+	l, err := args.List(0)
 	return ListValue(l), err
 }
 
@@ -1,12 +1,59 @@
 package tplexpr
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 )
 
 type Args struct {
-	args []Value
+	args  []Value
+	named ObjectValue
+	exec  *execState
+	call  bool // a call in a template, which must pass all required args
+}
+
+// namedArgs holds the arguments passed as name => value. It is passed as
+// the last argument of a call.
+type namedArgs struct {
+	ObjectValue
+}
+
+// newArgs returns the Args of a call in a template with the positional
+// args and the named args passed as last of args.
+func newArgs(args []Value, exec *execState) Args {
+	if n := len(args); n > 0 {
+		if named, ok := args[n-1].(namedArgs); ok {
+			return Args{args: args[:n-1], named: named.ObjectValue, exec: exec, call: true}
+		}
+	}
+	return Args{args: args, exec: exec, call: true}
+}
+
+// Context returns the context.Context of the render the call belongs to.
+// Builtins doing I/O should honor its deadline and cancellation.
+func (c *Args) Context() context.Context {
+	if c.exec == nil {
+		return context.Background()
+	}
+	return c.exec.ctx
+}
+
+// Call calls fn with args as part of the same render as c.
+func (c *Args) Call(fn Value, args ...Value) (Value, error) {
+	return callExec(c.exec, fn, args)
+}
+
+// Iter returns an iterator over the i-th argument, which stops with the
+// error of the render context once it is done.
+func (c *Args) Iter(i int) (ValueIter, error) {
+	return iterContext(c.Context(), c.Get(i))
+}
+
+// List returns the i-th argument as list. An iterator is consumed only
+// until the list exceeds the list size limit of the render.
+func (c *Args) List(i int) ([]Value, error) {
+	return c.exec.list(c.Get(i))
 }
 
 func (c *Args) Len() int {
@@ -29,11 +76,20 @@ func (c *Args) Get(i int) (v Value) {
 	return Nil
 }
 
+// Named returns the argument passed as name => value.
+func (c *Args) Named(name string) (v Value, ok bool) {
+	v, ok = c.named[name]
+	return
+}
+
 func (c *Args) All() []Value {
 	return append([]Value(nil), c.args...)
 }
 
 func BuiltinList(args Args) (Value, error) {
+	if err := args.exec.checkListSize(args.Len()); err != nil {
+		return nil, err
+	}
 	return ListValue(args.All()), nil
 }
 
@@ -41,6 +97,7 @@ type rangeIter struct {
 	start int
 	stop  int
 	step  int
+	exec  *execState
 }
 
 var _ ValueIter = &rangeIter{}
@@ -49,13 +106,18 @@ func (r *rangeIter) Next() (Value, error) {
 	if (r.step > 0 && r.start >= r.stop) || (r.step < 0 && r.start <= r.stop) {
 		return nil, ErrIterExhausted
 	}
+	if r.exec != nil {
+		if err := r.exec.step(); err != nil {
+			return nil, err
+		}
+	}
 	v := NumberValue(r.start)
 	r.start += r.step
 	return v, nil
 }
 
 func BuiltinRange(args Args) (Value, error) {
-	rng := &rangeIter{step: 1}
+	rng := &rangeIter{step: 1, exec: args.exec}
 
 	switch args.Len() {
 	case 0:
@@ -98,6 +160,37 @@ func BuiltinRange(args Args) (Value, error) {
 	return IterValue{rng}, nil
 }
 
+type enumerateIter struct {
+	iter ValueIter
+	i    int
+}
+
+var _ ValueIter = &enumerateIter{}
+
+func (e *enumerateIter) Next() (Value, error) {
+	v, err := e.iter.Next()
+	if err != nil {
+		return nil, err
+	}
+	item := ListValue{NumberValue(e.i), v}
+	e.i++
+	return item, nil
+}
+
+// BuiltinEnumerate yields [index, item] pairs of its first argument,
+// counting from the optional second argument.
+func BuiltinEnumerate(args Args) (Value, error) {
+	iter, err := args.Iter(0)
+	if err != nil {
+		return nil, err
+	}
+	start, err := args.GetDefault(1, NumberValue(0)).Number()
+	if err != nil {
+		return nil, err
+	}
+	return IterValue{&enumerateIter{iter, int(start)}}, nil
+}
+
 func BuiltinGet(args Args) (Value, error) {
 	obj, err := args.Get(0).Object()
 	if err != nil {
@@ -195,15 +288,32 @@ func BuiltinKind(args Args) (Value, error) {
 	return StringValue(args.Get(0).Kind().String()), nil
 }
 
+// BuiltinError fails the render with an *ErrRaised of the message and
+// kind, "error" by default.
+func BuiltinError(args Args) (Value, error) {
+	message, err := args.Get(0).String()
+	if err != nil {
+		return nil, err
+	}
+	kind, err := args.GetDefault(1, StringValue("error")).String()
+	if err != nil {
+		return nil, err
+	}
+	return nil, &ErrRaised{Message: message, Kind: kind}
+}
+
 var baseBuiltins = map[string]Value{
-	"list":  FuncValue(BuiltinList),
-	"true":  True,
-	"false": False,
-	"nil":   Nil,
-	"range": FuncValue(BuiltinRange),
-	"get":   FuncValue(BuiltinGet),
-	"json":  FuncValue(BuiltinJSON),
-	"kind":  FuncValue(BuiltinKind),
+	"list":      FuncValue(BuiltinList),
+	"true":      True,
+	"false":     False,
+	"nil":       Nil,
+	"range":     FuncValue(BuiltinRange),
+	"enumerate": FuncValue(BuiltinEnumerate),
+	"get":       FuncValue(BuiltinGet),
+	"json":      FuncValue(BuiltinJSON),
+	"kind":      FuncValue(BuiltinKind),
+	"error":     FuncValue(BuiltinError),
+	"raise":     FuncValue(BuiltinError),
 }
 
 func AddBaseBuiltins(c *Context) {
@@ -0,0 +1,418 @@
+package tplexpr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// BundleVersion is the version of the bundle format written by
+// WriteBundle. LoadBundle only accepts bundles of this version.
+const BundleVersion = 18
+
+var bundleMagic = [4]byte{'T', 'P', 'X', 'B'}
+
+var (
+	ErrBundleFormat        = errors.New("invalid bundle")
+	ErrBundleVersion       = errors.New("unsupported bundle version")
+	ErrFilterNotRegistered = errors.New("value filter is not registered")
+)
+
+var filterRegistry = struct {
+	mux     sync.RWMutex
+	filters map[string]ValueFilter
+	names   map[ValueFilter]string
+}{
+	filters: map[string]ValueFilter{},
+	names:   map[ValueFilter]string{},
+}
+
+// RegisterValueFilter registers f under name, so it can be referenced by
+// bundles. It is usually called from an init function.
+func RegisterValueFilter(name string, f ValueFilter) {
+	filterRegistry.mux.Lock()
+	defer filterRegistry.mux.Unlock()
+
+	if _, ok := filterRegistry.filters[name]; ok {
+		panic(fmt.Sprintf("tplexpr: value filter %s registered twice", name))
+	}
+	filterRegistry.filters[name] = f
+	filterRegistry.names[f] = name
+}
+
+func init() {
+	RegisterValueFilter("discard", DiscardFilter)
+}
+
+func lookupFilterName(f ValueFilter) (string, bool) {
+	filterRegistry.mux.RLock()
+	defer filterRegistry.mux.RUnlock()
+	name, ok := filterRegistry.names[f]
+	return name, ok
+}
+
+func lookupFilter(name string) (ValueFilter, bool) {
+	filterRegistry.mux.RLock()
+	defer filterRegistry.mux.RUnlock()
+	f, ok := filterRegistry.filters[name]
+	return f, ok
+}
+
+type bundleWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *bundleWriter) uvarint(v uint64) {
+	if w.err == nil {
+		n := binary.PutUvarint(w.buf[:], v)
+		_, w.err = w.w.Write(w.buf[:n])
+	}
+}
+
+func (w *bundleWriter) varint(v int64) {
+	if w.err == nil {
+		n := binary.PutVarint(w.buf[:], v)
+		_, w.err = w.w.Write(w.buf[:n])
+	}
+}
+
+func (w *bundleWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s)
+	}
+}
+
+func (w *bundleWriter) code(code []Instr) {
+	w.uvarint(uint64(len(code)))
+	for _, instr := range code {
+		w.uvarint(uint64(instr.op))
+		w.varint(int64(instr.iarg))
+		w.string(instr.sarg)
+		w.uvarint(uint64(instr.pos.Line))
+		w.uvarint(uint64(instr.pos.Column))
+	}
+}
+
+// WriteBundle writes the templates compiled by c in the binary bundle
+// format to w. Value filters are referenced by the name they were
+// registered with (see RegisterValueFilter).
+func WriteBundle(w io.Writer, c *CompileContext) error {
+	bw := bundleWriter{w: bufio.NewWriter(w)}
+	_, bw.err = bw.w.Write(bundleMagic[:])
+	bw.uvarint(BundleVersion)
+
+	bw.uvarint(uint64(len(c.valueFilters)))
+	for _, f := range c.valueFilters {
+		name, ok := lookupFilterName(f)
+		if !ok {
+			return fmt.Errorf("write bundle: %T: %w", f, ErrFilterNotRegistered)
+		}
+		bw.string(name)
+	}
+
+	bw.uvarint(uint64(len(c.subprogs)))
+	for _, subprog := range c.subprogs {
+		bw.string(subprog.Name)
+		bw.string(subprog.Template)
+		bw.uvarint(uint64(len(subprog.Args)))
+		for _, arg := range subprog.Args {
+			bw.string(arg)
+		}
+		bw.uvarint(uint64(len(subprog.Defaults)))
+		for _, def := range subprog.Defaults {
+			bw.uvarint(uint64(def))
+		}
+		bw.string(subprog.Rest)
+		bw.string(subprog.Kwargs)
+		bw.uvarint(uint64(subprog.Slots))
+		bw.uvarint(uint64(len(subprog.Captures)))
+		for _, from := range subprog.Captures {
+			bw.varint(int64(from))
+		}
+		if subprog.Inline {
+			bw.uvarint(1)
+		} else {
+			bw.uvarint(0)
+		}
+		bw.code(subprog.Code)
+	}
+
+	names := make([]string, 0, len(c.templates))
+	for name := range c.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw.uvarint(uint64(len(names)))
+	for _, name := range names {
+		bw.string(name)
+		tpl := c.templates[name]
+		bw.uvarint(uint64(tpl.Slots))
+		bw.code(tpl.Code)
+		bw.string(tpl.Extends)
+		blocks := make([]string, 0, len(tpl.Blocks))
+		for block := range tpl.Blocks {
+			blocks = append(blocks, block)
+		}
+		sort.Strings(blocks)
+		bw.uvarint(uint64(len(blocks)))
+		for _, block := range blocks {
+			bw.string(block)
+			bw.uvarint(uint64(tpl.Blocks[block]))
+		}
+	}
+
+	if bw.err != nil {
+		return fmt.Errorf("write bundle: %w", bw.err)
+	}
+	err := bw.w.Flush()
+	if err != nil {
+		return fmt.Errorf("write bundle: %w", err)
+	}
+	return nil
+}
+
+type bundleReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *bundleReader) fail(err error) {
+	if r.err == nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrBundleFormat
+		}
+		r.err = err
+	}
+}
+
+func (r *bundleReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *bundleReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+// len reads a length and makes sure that it fits into an int.
+func (r *bundleReader) len() int {
+	n := r.uvarint()
+	if n > 1<<31 {
+		r.fail(ErrBundleFormat)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *bundleReader) string() string {
+	n := r.len()
+	if r.err != nil || n == 0 {
+		return ""
+	}
+	buf := make([]byte, 0, min(n, 4096))
+	for len(buf) < n && r.err == nil {
+		chunk := min(n-len(buf), 4096)
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		_, err := io.ReadFull(r.r, buf[start:])
+		if err != nil {
+			r.fail(err)
+		}
+	}
+	return string(buf)
+}
+
+// code reads a code block and relocates the subprog and value filter
+// indices by the given offsets.
+func (r *bundleReader) code(subprogBase, numSubprogs int, filters []int) []Instr {
+	n := r.len()
+	code := []Instr{}
+	for i := 0; i < n && r.err == nil; i++ {
+		instr := Instr{
+			op:   r.len(),
+			iarg: int(r.varint()),
+			sarg: r.string(),
+			pos:  Pos{Line: r.len(), Column: r.len()},
+		}
+		if r.err != nil {
+			break
+		}
+		switch instr.op {
+		case emitSubprog, pushSubprog, emitCallSubprogNA, pushCallSubprogNA, emitTry:
+			if instr.iarg < 0 || instr.iarg >= numSubprogs {
+				r.fail(ErrBundleFormat)
+			}
+			instr.iarg += subprogBase
+		case emitExtends, pushSuper:
+			// -1 if not linked
+			if instr.iarg < -1 || instr.iarg >= numSubprogs {
+				r.fail(ErrBundleFormat)
+			}
+			if instr.iarg >= 0 {
+				instr.iarg += subprogBase
+			}
+		case pushOutputFilter:
+			if instr.iarg < 0 || instr.iarg >= len(filters) {
+				r.fail(ErrBundleFormat)
+				break
+			}
+			instr.iarg = filters[instr.iarg]
+		default:
+			if instr.op >= opCount {
+				r.fail(ErrBundleFormat)
+			}
+		}
+		code = append(code, instr)
+	}
+	return code
+}
+
+// LoadBundle reads a bundle written by WriteBundle and adds its templates
+// to c. It fails with ErrTemplateExists if c already has a template of the
+// same name.
+func LoadBundle(r io.Reader, c *CompileContext) error {
+	br := bundleReader{r: bufio.NewReader(r)}
+
+	var magic [4]byte
+	_, err := io.ReadFull(br.r, magic[:])
+	if err != nil || magic != bundleMagic {
+		return fmt.Errorf("load bundle: %w", ErrBundleFormat)
+	}
+	version := br.uvarint()
+	if br.err != nil {
+		return fmt.Errorf("load bundle: %w", br.err)
+	}
+	if version != BundleVersion {
+		return fmt.Errorf("load bundle: version %d: %w", version, ErrBundleVersion)
+	}
+
+	// filters maps the filter indices of the bundle to the ones of c
+	filters := make([]int, br.len())
+	newFilters := []ValueFilter{}
+	for i := range filters {
+		name := br.string()
+		if br.err != nil {
+			break
+		}
+		f, ok := lookupFilter(name)
+		if !ok {
+			return fmt.Errorf("load bundle: %s: %w", name, ErrFilterNotRegistered)
+		}
+		idx, ok := c.valueFilterMap[f]
+		if !ok {
+			idx = len(c.valueFilters) + len(newFilters)
+			newFilters = append(newFilters, f)
+		}
+		filters[i] = idx
+	}
+
+	subprogBase := len(c.subprogs)
+	numSubprogs := br.len()
+	subprogs := []Subprog{}
+	for i := 0; i < numSubprogs && br.err == nil; i++ {
+		subprog := Subprog{
+			Name:     br.string(),
+			Template: br.string(),
+		}
+		numArgs := br.len()
+		for j := 0; j < numArgs && br.err == nil; j++ {
+			subprog.Args = append(subprog.Args, br.string())
+		}
+		numDefaults := br.len()
+		if numDefaults > numArgs {
+			br.fail(ErrBundleFormat)
+		}
+		for j := 0; j < numDefaults && br.err == nil; j++ {
+			def := br.len()
+			if def >= numSubprogs {
+				br.fail(ErrBundleFormat)
+			}
+			subprog.Defaults = append(subprog.Defaults, def+subprogBase)
+		}
+		subprog.Rest = br.string()
+		subprog.Kwargs = br.string()
+		params := len(subprog.Args)
+		if subprog.Rest != "" {
+			params++
+		}
+		if subprog.Kwargs != "" {
+			params++
+		}
+		subprog.Slots = br.len()
+		if subprog.Slots < params {
+			br.fail(ErrBundleFormat)
+		}
+		numCaptures := br.len()
+		for j := 0; j < numCaptures && br.err == nil; j++ {
+			subprog.Captures = append(subprog.Captures, int(br.varint()))
+		}
+		subprog.Inline = br.uvarint() != 0
+		subprog.Code = br.code(subprogBase, numSubprogs, filters)
+		subprogs = append(subprogs, subprog)
+	}
+
+	templates := map[string]Template{}
+	numTemplates := br.len()
+	for i := 0; i < numTemplates && br.err == nil; i++ {
+		tpl := Template{}
+		name := br.string()
+		tpl.Slots = br.len()
+		tpl.Code = br.code(subprogBase, numSubprogs, filters)
+		tpl.Extends = br.string()
+		if tpl.Extends != "" && (len(tpl.Code) == 0 || tpl.Code[len(tpl.Code)-1].op != emitExtends) {
+			br.fail(ErrBundleFormat)
+		}
+		numBlocks := br.len()
+		for j := 0; j < numBlocks && br.err == nil; j++ {
+			block := br.string()
+			idx := br.len()
+			if idx >= numSubprogs {
+				br.fail(ErrBundleFormat)
+			}
+			if tpl.Blocks == nil {
+				tpl.Blocks = map[string]int{}
+			}
+			tpl.Blocks[block] = idx + subprogBase
+		}
+		templates[name] = tpl
+	}
+	if br.err != nil {
+		return fmt.Errorf("load bundle: %w", br.err)
+	}
+
+	for name := range templates {
+		if _, ok := c.templates[name]; ok {
+			return fmt.Errorf("load bundle: create template '%s': %w", name, ErrTemplateExists)
+		}
+	}
+	for _, f := range newFilters {
+		c.valueFilterMap[f] = len(c.valueFilters)
+		c.valueFilters = append(c.valueFilters, f)
+	}
+	c.subprogs = append(c.subprogs, subprogs...)
+	for name, tpl := range templates {
+		c.templates[name] = tpl
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package tplexpr
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func compileBundle(t *testing.T, fsys fs.FS, globs ...string) []byte {
+	cc := NewCompileContext()
+	for _, glob := range globs {
+		matches, err := fs.Glob(fsys, glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fileName := range matches {
+			data, err := fs.ReadFile(fsys, fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cc.ParseTemplate(fileName, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	buf := bytes.Buffer{}
+	err := WriteBundle(&buf, &cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBundle(t *testing.T) {
+	fsys := os.DirFS("testdata")
+	bundle := compileBundle(t, fsys, "*.test.txt", "*.template.txt")
+
+	// the bundle is loaded next to templates that have subprogs of their own
+	extra := fstest.MapFS{
+		"extra.txt": {Data: []byte(`${block(b, x)}<$x>${endblock discard b(1) enddiscard b(2)}`)},
+	}
+	store, err := BuildStore().
+		AddFS(extra, "*.txt").
+		AddBundle(bundle).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := loadTestResults(t, fsys)
+	expected["extra.txt"] = "<2>"
+	vars := testFileVars().Build()
+	for name, result := range expected {
+		t.Logf("Render %s", name)
+		sb := strings.Builder{}
+		err := store.Render(&sb, name, vars)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if sb.String() != result {
+			t.Errorf("expected %q, found %q", result, sb.String())
+		}
+	}
+
+	// encoding is deterministic
+	if !bytes.Equal(bundle, compileBundle(t, fsys, "*.test.txt", "*.template.txt")) {
+		t.Error("bundles of the same templates differ")
+	}
+}
+
+func TestBundleErrors(t *testing.T) {
+	bundle := compileBundle(t, fstest.MapFS{
+		"a.txt": {Data: []byte(`${block(b, x)}$x${endblock b(1)}`)},
+	}, "*.txt")
+
+	newVersion := append([]byte(nil), bundle...)
+	newVersion[4] = BundleVersion + 1
+
+	cases := []struct {
+		data []byte
+		err  error
+	}{
+		{nil, ErrBundleFormat},
+		{[]byte("not a bundle"), ErrBundleFormat},
+		{bundle[:len(bundle)-3], ErrBundleFormat},
+		{newVersion, ErrBundleVersion},
+	}
+
+	for _, c := range cases {
+		cc := NewCompileContext()
+		err := LoadBundle(bytes.NewReader(c.data), &cc)
+		if !errors.Is(err, c.err) {
+			t.Errorf("expected %v, got %v", c.err, err)
+		}
+		if len(cc.templates) != 0 || len(cc.subprogs) != 0 {
+			t.Error("failed load changed the compile context")
+		}
+	}
+
+	cc := NewCompileContext()
+	err := LoadBundle(bytes.NewReader(bundle), &cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadBundle(bytes.NewReader(bundle), &cc)
+	if !errors.Is(err, ErrTemplateExists) {
+		t.Errorf("expected ErrTemplateExists, got %v", err)
+	}
+
+	type unregisteredFilter struct{ discardFilter }
+	cc = NewCompileContext()
+	cc.PushOutputFilter(unregisteredFilter{})
+	err = WriteBundle(&bytes.Buffer{}, &cc)
+	if !errors.Is(err, ErrFilterNotRegistered) {
+		t.Errorf("expected ErrFilterNotRegistered, got %v", err)
+	}
+}
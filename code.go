@@ -4,6 +4,7 @@ type Instr struct {
 	op   int
 	iarg int
 	sarg string
+	pos  Pos
 }
 
 const (
@@ -54,6 +55,36 @@ const (
 	assignKeyDyn
 	pushObject
 	extendObject
+	emitLocal
+	pushLocal
+	declareLocal
+	clearLocal
+	exportLocal
+	pushList
+	emitIndex
+	pushIndex
+	emitSlice
+	pushSlice
+	emitNeg
+	pushNeg
+	jumpNil
+	jumpNotNil
+	loopGuard
+	unpack
+	pushLoop
+	jumpIterNotEmpty
+	emitExtends
+	pushSuper
+	pushImport
+	emitCallMethod
+	pushCallMethod
+	pushNamedArgs
+	returnPop
+	emitTry
+	signalLoop
+	pushLoopSignal
+
+	opCount // number of opcodes, must be last
 )
 
 // Compare constants
@@ -64,6 +95,8 @@ const (
 	GE
 	LT
 	LE
+	IN
+	NOTIN
 )
 
 // Binary OP Constatns
@@ -72,4 +105,7 @@ const (
 	SUB
 	MUL
 	DIV
+	MOD
+	FLOORDIV
+	POW
 )
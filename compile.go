@@ -3,21 +3,35 @@ package tplexpr
 import (
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 )
 
 type CompileContext struct {
 	code           []Instr
 	subprogs       []Subprog
-	loopJumps      *[]loopJump
+	loop           *loopScope
+	scopes         int
+	filters        int
 	valueFilters   []ValueFilter
 	valueFilterMap map[ValueFilter]int
 	templates      map[string]Template
+	template       string
+	pos            Pos
+	frame          *frameScope
+	nilJumps       *[]int // jumps to the end of the optional chain
+	extends        *ExtendsNode
+	blocks         map[string]int
+	block          string // the top level block being compiled
+	linkErr        error  // the error of linking in Compile
 }
 
 func NewCompileContext() CompileContext {
 	return CompileContext{
 		valueFilterMap: map[ValueFilter]int{},
 		templates:      map[string]Template{},
+		frame:          &frameScope{template: true},
 	}
 }
 
@@ -30,7 +44,16 @@ type ValueFilter interface {
 	Filter(s string) (string, error)
 }
 
-var ErrTemplateExists = errors.New("template exists already")
+var (
+	ErrTemplateExists = errors.New("template exists already")
+	ErrLoopControl    = errors.New("break or continue outside of loop")
+	ErrAssignCaptured = errors.New("can not assign a variable of an enclosing scope in a closure")
+	ErrExtends        = errors.New("extends must be used once at the top level of a template")
+	ErrParentNotFound = errors.New("parent template not found")
+	ErrExtendsCycle   = errors.New("template extends itself")
+	ErrSuperNotFound  = errors.New("no parent block for super")
+	ErrReturn         = errors.New("return outside of a block or lambda")
+)
 
 func (c *CompileContext) CompileTemplate(name string, node Node) error {
 	_, ok := c.templates[name]
@@ -38,13 +61,30 @@ func (c *CompileContext) CompileTemplate(name string, node Node) error {
 		return fmt.Errorf("create template '%s': %w", name, ErrTemplateExists)
 	}
 	defer c.setCode(c.code)
+	defer c.setTemplate(c.template, c.pos)
+	defer c.setFrame(c.frame)
+	defer c.setExtends(c.extends, c.blocks, c.block)
 	c.code = nil
+	c.template = name
+	c.pos = Pos{}
+	c.frame = &frameScope{template: true}
+	c.extends = nil
+	c.blocks = nil
+	c.block = ""
 
 	err := node.Compile(c, CompileEmit)
 	if err != nil {
 		return err
 	}
-	c.templates[name] = Template{c.code}
+	tpl := Template{Code: c.code, Slots: c.frame.size, Blocks: c.blocks}
+	if c.extends != nil {
+		c.PopOutputFilter()
+		c.SetPos(c.extends.Pos)
+		c.pushInstr(emitExtends, -1, c.extends.Template)
+		tpl.Code = c.code
+		tpl.Extends = c.extends.Template
+	}
+	c.templates[name] = tpl
 	return nil
 }
 
@@ -52,7 +92,7 @@ func (c *CompileContext) ParseTemplate(name string, data []byte) error {
 	p := NewParser(data)
 	n, err := p.Parse()
 	if err != nil {
-		return err
+		return setTemplateName(err, name)
 	}
 	return c.CompileTemplate(name, n)
 }
@@ -61,12 +101,35 @@ func (c *CompileContext) setCode(code []Instr) {
 	c.code = code
 }
 
-func (c *CompileContext) setLoopJumps(loopJumps *[]loopJump) {
-	c.loopJumps = loopJumps
+func (c *CompileContext) setTemplate(template string, pos Pos) {
+	c.template = template
+	c.pos = pos
+}
+
+// SetPos sets the source position that is recorded for the following
+// instructions. It is reported in the frames of a RenderError.
+func (c *CompileContext) SetPos(pos Pos) {
+	c.pos = pos
+}
+
+func (c *CompileContext) setFrame(frame *frameScope) {
+	c.frame = frame
+}
+
+func (c *CompileContext) setExtends(extends *ExtendsNode, blocks map[string]int, block string) {
+	c.extends = extends
+	c.blocks = blocks
+	c.block = block
+}
+
+func (c *CompileContext) setLoop(loop *loopScope, scopes, filters int) {
+	c.loop = loop
+	c.scopes = scopes
+	c.filters = filters
 }
 
 func (c *CompileContext) pushInstr(op, iarg int, sarg string) {
-	c.code = append(c.code, Instr{op, iarg, sarg})
+	c.code = append(c.code, Instr{op, iarg, sarg, c.pos})
 }
 
 func (c *CompileContext) Value(mode int, value string) {
@@ -86,30 +149,140 @@ func (c *CompileContext) Code() []Instr {
 	return c.code
 }
 
-func (c *CompileContext) pushSubprog(args []string, code []Instr) int {
+func (c *CompileContext) pushSubprog(subprog Subprog) int {
 	idx := len(c.subprogs)
-	c.subprogs = append(c.subprogs, Subprog{args, code})
+	subprog.Template = c.template
+	c.subprogs = append(c.subprogs, subprog)
 	return idx
 }
 
 func (c *CompileContext) WithSubprog(args []string, f func() error) (int, error) {
+	return c.WithNamedSubprog("", args, f)
+}
+
+// WithNamedSubprog is like WithSubprog, but the name of the subprog is
+// reported in the frames of a RenderError.
+func (c *CompileContext) WithNamedSubprog(name string, args []string, f func() error) (int, error) {
+	return c.withParamsSubprog(name, args, Params{}, f)
+}
+
+// withParamsSubprog is like WithNamedSubprog, but the subprog takes params
+// besides args. The default values are compiled to inline subprogs
+// evaluated in the frame of the subprog when it is called.
+func (c *CompileContext) withParamsSubprog(name string, args []string, params Params, f func() error) (int, error) {
+	defer c.setCode(c.code)
+	defer c.setLoop(c.loop, c.scopes, c.filters)
+	defer c.setFrame(c.frame)
+	c.code = nil
+	c.loop = nil
+	c.scopes = 0
+	c.filters = 0
+	c.frame = &frameScope{parent: c.frame}
+	for _, arg := range args {
+		c.frame.push(arg)
+	}
+	if params.Rest != "" {
+		c.frame.push(params.Rest)
+	}
+	if params.Kwargs != "" {
+		c.frame.push(params.Kwargs)
+	}
+
+	var defaults []int
+	for _, def := range params.Defaults {
+		subprog, err := c.withInlineSubprog(func() error {
+			return def.Compile(c, CompileEmit)
+		})
+		if err != nil {
+			return 0, err
+		}
+		defaults = append(defaults, subprog)
+	}
+
+	err := f()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.pushSubprog(Subprog{
+		Args:     args,
+		Defaults: defaults,
+		Rest:     params.Rest,
+		Kwargs:   params.Kwargs,
+		Code:     c.code,
+		Name:     name,
+		Slots:    c.frame.size,
+		Captures: c.frame.captureSources(),
+	}), nil
+}
+
+// withInlineSubprog compiles a subprog without arguments that runs in the
+// frame of the caller. It must be called with CallSubprogNA.
+func (c *CompileContext) withInlineSubprog(f func() error) (int, error) {
 	defer c.setCode(c.code)
+	defer c.setLoop(c.loop, c.scopes, c.filters)
 	c.code = nil
+	c.loop = nil
+	c.scopes = 0
+	c.filters = 0
+	c.frame.beginScope()
 	err := f()
+	c.frame.endScope()
 	if err != nil {
 		return 0, err
 	}
 
-	return c.pushSubprog(args, c.code), nil
+	return c.pushSubprog(Subprog{Code: c.code, Inline: true}), nil
 }
 
 func (c *CompileContext) WithLoopJumps(loopJumps *[]loopJump, f func() error) error {
-	defer c.setLoopJumps(c.loopJumps)
-	c.loopJumps = loopJumps
+	defer c.setLoop(c.loop, c.scopes, c.filters)
+	c.loop = &loopScope{jumps: loopJumps, scopes: c.scopes, filters: c.filters}
 	return f()
 }
 
+// jumpLoop emits a jump to the next iteration (loopJumpNext) or to the end
+// (loopJumpEnd) of the innermost loop. Scopes and output filters opened
+// inside the loop body are closed before jumping.
+func (c *CompileContext) jumpLoop(kind int) error {
+	if c.loop == nil {
+		return ErrLoopControl
+	}
+	for i := c.scopes; i > c.loop.scopes; i-- {
+		c.pushInstr(endScope, 0, "")
+	}
+	for i := c.filters; i > c.loop.filters; i-- {
+		c.pushInstr(popOutputFilter, 0, "")
+	}
+	*c.loop.jumps = append(*c.loop.jumps, loopJump{len(c.code), kind})
+	if c.loop.signal {
+		// the try continues the jump after its output was flushed
+		c.pushInstr(signalLoop, kind, "")
+		return nil
+	}
+	c.pushInstr(jump, 0, "")
+	return nil
+}
+
 func (c *CompileContext) Var(mode int, name string) {
+	if idx, ok := c.frame.resolve(name); ok {
+		switch mode {
+		case CompileEmit:
+			c.pushInstr(emitLocal, idx, name)
+		case CompilePush:
+			c.pushInstr(pushLocal, idx, name)
+		}
+		return
+	}
+	if c.isSuper(name) {
+		// the subprog is set by Link
+		c.pushInstr(pushSuper, -1, c.block)
+		if mode == CompileEmit {
+			c.pushInstr(emitPop, 0, "")
+		}
+		return
+	}
+
 	switch mode {
 	case CompileEmit:
 		c.pushInstr(emitFetch, 0, name)
@@ -118,6 +291,99 @@ func (c *CompileContext) Var(mode int, name string) {
 	}
 }
 
+// IsLocal reports whether name refers to a local variable, which is
+// resolved at compile time instead of being looked up by name.
+func (c *CompileContext) IsLocal(name string) bool {
+	_, ok := c.frame.resolve(name)
+	return ok || c.isSuper(name)
+}
+
+// isSuper reports whether name refers to the block of the parent template
+// that is overridden by the block being compiled.
+func (c *CompileContext) isSuper(name string) bool {
+	return name == "super" && c.block != "" && c.extends != nil
+}
+
+// Declare emits the declaration of name with the value on top of the
+// stack.
+func (c *CompileContext) Declare(name string) {
+	if c.frame.dynamic() {
+		c.pushInstr(declarePop, 0, name)
+	} else {
+		c.pushInstr(declareLocal, c.frame.declare(name), name)
+	}
+}
+
+// Assign emits the assignment of the value on top of the stack to the
+// variable name, which must have been declared. Lambdas and blocks capture
+// the locals of their enclosing frames by value when they are created
+// and see the variables of the template as they were at that time, so
+// they can only assign their own arguments and locals.
+func (c *CompileContext) Assign(name string) error {
+	if idx, ok := c.frame.local(name); ok {
+		c.pushInstr(declareLocal, idx, name)
+		return nil
+	}
+	if !c.frame.template {
+		return fmt.Errorf("assign %s: %w", name, ErrAssignCaptured)
+	}
+	c.pushInstr(storePop, 0, name)
+	return nil
+}
+
+// exportLocals declares all visible locals dynamically, so they can be
+// used by included templates.
+func (c *CompileContext) exportLocals() {
+	for _, name := range c.frame.visible() {
+		idx, _ := c.frame.resolve(name)
+		c.pushInstr(exportLocal, idx, name)
+	}
+}
+
+// hoistLocals declares the locals that are declared directly in body at
+// the start of the current scope. In a loop, a use before the declaration
+// then sees the value of the previous iteration, like it does for dynamic
+// variables. Until the first declaration, the local has the value of the
+// variable it shadows.
+func (c *CompileContext) hoistLocals(body []Node) {
+	for _, name := range declaredNames(body) {
+		if c.frame.declared(name) {
+			continue
+		}
+		idx, outer := c.frame.resolve(name)
+		slot := c.frame.declare(name)
+		if outer {
+			c.pushInstr(pushLocal, idx, name)
+			c.pushInstr(declareLocal, slot, name)
+		} else {
+			c.pushInstr(clearLocal, slot, name)
+		}
+	}
+}
+
+// declaredNames returns the names declared by nodes in the current scope.
+func declaredNames(nodes []Node) []string {
+	names := []string{}
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *DeclareNode:
+			names = append(names, n.Name)
+		case *BlockNode:
+			names = append(names, n.Name)
+		case *ImportNode:
+			if n.As != "" {
+				names = append(names, n.As)
+			}
+			names = append(names, n.Names...)
+		case *CompoundNode:
+			names = append(names, declaredNames(n.Nodes)...)
+		case *DiscardNode:
+			names = append(names, declaredNames(n.Body)...)
+		}
+	}
+	return names
+}
+
 func (c *CompileContext) Call(mode int, name string, argc int) {
 	switch mode {
 	case CompileEmit:
@@ -127,6 +393,17 @@ func (c *CompileContext) Call(mode int, name string, argc int) {
 	}
 }
 
+// callMethod is like Call, but calls the function the first argument has
+// as key name if it is an object with such a key.
+func (c *CompileContext) callMethod(mode int, name string, argc int) {
+	switch mode {
+	case CompileEmit:
+		c.pushInstr(emitCallMethod, argc, name)
+	case CompilePush:
+		c.pushInstr(pushCallMethod, argc, name)
+	}
+}
+
 func (c *CompileContext) DynCall(mode int, argc int) {
 	switch mode {
 	case CompileEmit:
@@ -163,6 +440,53 @@ func (c *CompileContext) Attr(mode int, name string) {
 	}
 }
 
+func (c *CompileContext) Not(mode int) {
+	switch mode {
+	case CompileEmit:
+		c.pushInstr(emitNot, 0, "")
+	case CompilePush:
+		c.pushInstr(pushNot, 0, "")
+	}
+}
+
+func (c *CompileContext) Neg(mode int) {
+	switch mode {
+	case CompileEmit:
+		c.pushInstr(emitNeg, 0, "")
+	case CompilePush:
+		c.pushInstr(pushNeg, 0, "")
+	}
+}
+
+func (c *CompileContext) Index(mode int) {
+	switch mode {
+	case CompileEmit:
+		c.pushInstr(emitIndex, 0, "")
+	case CompilePush:
+		c.pushInstr(pushIndex, 0, "")
+	}
+}
+
+func (c *CompileContext) Slice(mode int) {
+	switch mode {
+	case CompileEmit:
+		c.pushInstr(emitSlice, 0, "")
+	case CompilePush:
+		c.pushInstr(pushSlice, 0, "")
+	}
+}
+
+// optionalAttr is Attr for a?.name, which does not call NameError if the
+// key is missing.
+func (c *CompileContext) optionalAttr(mode int, name string) {
+	switch mode {
+	case CompileEmit:
+		c.pushInstr(emitAttr, 1, name)
+	case CompilePush:
+		c.pushInstr(pushAttr, 1, name)
+	}
+}
+
 func (c *CompileContext) Compare(mode int, cmp int) {
 	switch mode {
 	case CompileEmit:
@@ -208,6 +532,7 @@ func (c *CompileContext) Nil(mode int) {
 }
 
 func (c *CompileContext) IncludeTemplate(mode int, name string) {
+	c.exportLocals()
 	switch mode {
 	case CompileEmit:
 		c.pushInstr(emitTemplate, 0, name)
@@ -217,6 +542,7 @@ func (c *CompileContext) IncludeTemplate(mode int, name string) {
 }
 
 func (c *CompileContext) IncludeTemplateDyn(mode int) {
+	c.exportLocals()
 	switch mode {
 	case CompileEmit:
 		c.pushInstr(emitTemplateDyn, 0, "")
@@ -233,23 +559,34 @@ func (c *CompileContext) PushOutputFilter(f ValueFilter) {
 		c.valueFilterMap[f] = idx
 	}
 	c.pushInstr(pushOutputFilter, idx, "")
+	c.filters++
 }
 
 func (c *CompileContext) PopOutputFilter() {
 	c.pushInstr(popOutputFilter, 0, "")
+	c.filters--
 }
 
 func (c *CompileContext) BeginScope() {
 	c.pushInstr(beginScope, 0, "")
+	c.scopes++
+	c.frame.beginScope()
 }
 
 func (c *CompileContext) EndScope() {
 	c.pushInstr(endScope, 0, "")
+	c.scopes--
+	c.frame.endScope()
 }
 
+// Compile links the templates and returns a Context to render them. An
+// error of linking is returned by Err, a template whose parent was not
+// found fails when it is rendered.
 func (c *CompileContext) Compile() (code []Instr, ctx Context) {
+	c.linkErr = c.Link()
 	code = c.code
 	ctx = NewContext()
+	ctx.frame = make([]Value, c.frame.size)
 	ctx.subprogs = c.subprogs
 	ctx.valueFilters = c.valueFilters
 	ctx.templates = map[string]Template{}
@@ -259,17 +596,28 @@ func (c *CompileContext) Compile() (code []Instr, ctx Context) {
 	return
 }
 
+// Err returns the error of linking the templates in the last Compile.
+func (c *CompileContext) Err() error {
+	return c.linkErr
+}
+
 func (n *ValueNode) Compile(ctx *CompileContext, mode int) error {
 	ctx.Value(mode, n.Value)
 	return nil
 }
 
 func (n *VarNode) Compile(ctx *CompileContext, mode int) error {
+	ctx.SetPos(n.Pos)
 	ctx.Var(mode, n.Name)
 	return nil
 }
 
 func (n *CallNode) Compile(ctx *CompileContext, mode int) error {
+	local := ctx.IsLocal(n.Name)
+	if local {
+		ctx.SetPos(n.Pos)
+		ctx.Var(CompilePush, n.Name)
+	}
 	for _, arg := range n.Args {
 		err := arg.Compile(ctx, CompilePush)
 		if err != nil {
@@ -277,7 +625,27 @@ func (n *CallNode) Compile(ctx *CompileContext, mode int) error {
 		}
 	}
 
-	ctx.Call(mode, n.Name, len(n.Args))
+	ctx.SetPos(n.Pos)
+	if local {
+		ctx.DynCall(mode, len(n.Args))
+	} else if n.Method {
+		ctx.callMethod(mode, n.Name, len(n.Args))
+	} else {
+		ctx.Call(mode, n.Name, len(n.Args))
+	}
+	return nil
+}
+
+func (n *NamedArgsNode) Compile(ctx *CompileContext, mode int) error {
+	ctx.pushInstr(pushObject, 0, "")
+	for i, name := range n.Names {
+		err := n.Values[i].Compile(ctx, CompilePush)
+		if err != nil {
+			return err
+		}
+		ctx.pushInstr(assignKey, 0, name)
+	}
+	ctx.pushInstr(pushNamedArgs, 0, "")
 	return nil
 }
 
@@ -292,6 +660,7 @@ func (n *DynCallNode) Compile(ctx *CompileContext, mode int) error {
 			return err
 		}
 	}
+	ctx.SetPos(n.Pos)
 	ctx.DynCall(mode, len(n.Args))
 	return nil
 }
@@ -299,7 +668,7 @@ func (n *DynCallNode) Compile(ctx *CompileContext, mode int) error {
 func compileNodes(ctx *CompileContext, nodes []Node, mode int) error {
 	switch mode {
 	case CompilePush:
-		subprog, err := ctx.WithSubprog(nil, func() error {
+		subprog, err := ctx.withInlineSubprog(func() error {
 			for _, node := range nodes {
 				err := node.Compile(ctx, CompileEmit)
 				if err != nil {
@@ -333,12 +702,110 @@ func (n *AttrNode) Compile(ctx *CompileContext, mode int) error {
 	if err != nil {
 		return err
 	}
-	ctx.Attr(mode, n.Name)
+	ctx.SetPos(n.Pos)
+	if n.Optional {
+		ctx.optionalAttr(mode, n.Name)
+	} else {
+		ctx.Attr(mode, n.Name)
+	}
+	return nil
+}
+
+func (n *OptionalChainNode) Compile(ctx *CompileContext, mode int) error {
+	jumps := []int{}
+	nilJumps := ctx.nilJumps
+	ctx.nilJumps = &jumps
+	err := n.Expr.Compile(ctx, CompilePush)
+	ctx.nilJumps = nilJumps
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jumps {
+		ctx.code[j].iarg = len(ctx.code) - j - 1
+	}
+	if mode == CompileEmit {
+		ctx.pushInstr(emitPop, 0, "")
+	}
+	return nil
+}
+
+func (n *OptionalNode) Compile(ctx *CompileContext, mode int) error {
+	if ctx.nilJumps == nil || mode != CompilePush {
+		return errors.New("optional access outside of an optional chain")
+	}
+	err := n.Expr.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	*ctx.nilJumps = append(*ctx.nilJumps, len(ctx.code))
+	ctx.pushInstr(jumpNil, 0, "")
+	return nil
+}
+
+func (n *CoalesceNode) Compile(ctx *CompileContext, mode int) error {
+	jumpLabels := []int{}
+	lastIdx := len(n.Exprs) - 1
+
+	for i, n := range n.Exprs {
+		err := n.Compile(ctx, CompilePush)
+		if err != nil {
+			return err
+		}
+
+		if i != lastIdx {
+			jumpLabels = append(jumpLabels, len(ctx.code))
+			ctx.pushInstr(jumpNotNil, 0, "")
+			ctx.pushInstr(discardPop, 0, "")
+		}
+	}
+
+	for _, lb := range jumpLabels {
+		ctx.code[lb].iarg = len(ctx.code) - lb - 1
+	}
+
+	if mode == CompileEmit {
+		ctx.pushInstr(emitPop, 0, "")
+	}
+	return nil
+}
+
+func (n *IndexNode) Compile(ctx *CompileContext, mode int) error {
+	err := n.Expr.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	err = n.Index.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	ctx.SetPos(n.Pos)
+	ctx.Index(mode)
+	return nil
+}
+
+func (n *SliceNode) Compile(ctx *CompileContext, mode int) error {
+	err := n.Expr.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	for _, bound := range []Node{n.Low, n.High} {
+		if bound == nil {
+			ctx.Nil(CompilePush)
+			continue
+		}
+		err = bound.Compile(ctx, CompilePush)
+		if err != nil {
+			return err
+		}
+	}
+	ctx.SetPos(n.Pos)
+	ctx.Slice(mode)
 	return nil
 }
 
 func (n *SubprogNode) Compile(ctx *CompileContext, mode int) error {
-	index, err := ctx.WithSubprog(n.Args, func() error {
+	index, err := ctx.withParamsSubprog("", n.Args, n.Params, func() error {
 		return n.Prog.Compile(ctx, CompileEmit)
 	})
 	if err != nil {
@@ -359,6 +826,7 @@ func (n *CompareNode) Compile(ctx *CompileContext, mode int) error {
 		return err
 	}
 
+	ctx.SetPos(n.Pos)
 	ctx.Compare(mode, n.Compare)
 	return nil
 }
@@ -434,6 +902,7 @@ func (n *BinaryOPNode) Compile(ctx *CompileContext, mode int) error {
 		if err != nil {
 			return err
 		}
+		ctx.SetPos(op.Pos)
 		if i == lastIndex {
 			ctx.BinaryOP(mode, op.Op)
 		} else {
@@ -443,13 +912,38 @@ func (n *BinaryOPNode) Compile(ctx *CompileContext, mode int) error {
 	return nil
 }
 
+func (n *NotNode) Compile(ctx *CompileContext, mode int) error {
+	err := n.Expr.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	ctx.Not(mode)
+	return nil
+}
+
+func (n *NegNode) Compile(ctx *CompileContext, mode int) error {
+	err := n.Expr.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	ctx.SetPos(n.Pos)
+	ctx.Neg(mode)
+	return nil
+}
+
 func (n *NumberNode) Compile(ctx *CompileContext, mode int) error {
 	ctx.Number(mode, n.Value)
 	return nil
 }
 
 func (n *BlockNode) Compile(ctx *CompileContext, mode int) error {
-	subprog, err := ctx.WithSubprog(n.Args, func() error {
+	// blocks at the top level of a template can be overridden by templates
+	// extending it
+	topLevel := ctx.frame.dynamic()
+	if topLevel {
+		ctx.block = n.Name
+	}
+	subprog, err := ctx.withParamsSubprog(n.Name, n.Args, n.Params, func() error {
 		for _, n := range n.Body {
 			err := n.Compile(ctx, CompileEmit)
 			if err != nil {
@@ -458,12 +952,21 @@ func (n *BlockNode) Compile(ctx *CompileContext, mode int) error {
 		}
 		return nil
 	})
+	if topLevel {
+		ctx.block = ""
+	}
 	if err != nil {
 		return err
 	}
 
+	if topLevel {
+		if ctx.blocks == nil {
+			ctx.blocks = map[string]int{}
+		}
+		ctx.blocks[n.Name] = subprog
+	}
 	ctx.Subprog(CompilePush, subprog)
-	ctx.pushInstr(declarePop, 0, n.Name)
+	ctx.Declare(n.Name)
 	return nil
 }
 
@@ -483,13 +986,13 @@ func (n *IfNode) Compile(ctx *CompileContext, mode int) (err error) {
 	branchStarts := make([]int, len(n.Branches)+1) // +1 for the alternative
 
 	for i := range n.Branches {
+		branchStarts[i] = len(ctx.code)
 		if i != 0 {
 			// discard expr from previous branch
 			ctx.pushInstr(discardPop, 0, "")
 		}
 
 		b := &n.Branches[i]
-		branchStarts[i] = len(ctx.code)
 
 		err = b.Expr.Compile(ctx, CompilePush)
 		if err != nil {
@@ -512,12 +1015,12 @@ func (n *IfNode) Compile(ctx *CompileContext, mode int) (err error) {
 	}
 
 	// discard expr from the last branch if it was skipped
+	branchStarts[len(n.Branches)] = len(ctx.code)
 	if len(n.Branches) > 0 {
 		ctx.pushInstr(discardPop, 0, "")
 	}
 
 	// compile the alternative (else) branch
-	branchStarts[len(n.Branches)] = len(ctx.code)
 	ctx.BeginScope()
 	err = compileNodes(ctx, n.Alt, mode)
 	if err != nil {
@@ -546,10 +1049,26 @@ func (n *DeclareNode) Compile(ctx *CompileContext, mode int) error {
 	if err != nil {
 		return err
 	}
-	ctx.pushInstr(declarePop, 0, n.Name)
+	ctx.Declare(n.Name)
 	return nil
 }
 
+func (n *AssignNode) Compile(ctx *CompileContext, mode int) error {
+	err := n.Value.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	ctx.SetPos(n.Pos)
+	return ctx.Assign(n.Name)
+}
+
+func (n *ForNode) vars() []string {
+	if len(n.Vars) == 0 {
+		return []string{n.Var}
+	}
+	return n.Vars
+}
+
 func (n *ForNode) compileEmit(ctx *CompileContext) error {
 	var loopJumps []loopJump
 	err := n.Expr.Compile(ctx, CompilePush)
@@ -557,13 +1076,37 @@ func (n *ForNode) compileEmit(ctx *CompileContext) error {
 		return err
 	}
 
-	ctx.pushInstr(pushIter, 0, "")
+	ctx.SetPos(n.Pos)
+	ctx.pushInstr(pushIter, len(n.Vars), "")
 	ctx.BeginScope()
-	ctx.pushInstr(pushNil, 0, "")
-	ctx.pushInstr(declarePop, 0, n.Var)
+	parent := ctx.frame.push("")
+	if ctx.IsLocal("loop") {
+		ctx.Var(CompilePush, "loop") // the parent loop
+	} else {
+		ctx.pushInstr(pushNil, 0, "")
+	}
+	ctx.pushInstr(declareLocal, parent, "")
+	loop := ctx.frame.declare("loop")
+	var slots []int
+	for _, name := range n.vars() {
+		slots = append(slots, ctx.frame.declare(name))
+	}
+	ctx.hoistLocals(n.Body)
 
 	nextIndex := len(ctx.code)
-	ctx.pushInstr(iterNextOrJump, 0, n.Var)
+	if len(n.Vars) == 0 {
+		ctx.pushInstr(iterNextOrJump, 0, n.Var)
+		ctx.pushInstr(declareLocal, slots[0], n.Var)
+	} else {
+		ctx.pushInstr(iterNextOrJump, 0, strings.Join(n.Vars, ", "))
+		ctx.pushInstr(unpack, len(n.Vars), "")
+		for i := len(n.Vars) - 1; i >= 0; i-- {
+			ctx.pushInstr(declareLocal, slots[i], n.Vars[i])
+		}
+	}
+	ctx.pushInstr(pushLocal, parent, "")
+	ctx.pushInstr(pushLoop, 0, "")
+	ctx.pushInstr(declareLocal, loop, "loop")
 	err = ctx.WithLoopJumps(&loopJumps, func() error {
 		for _, n := range n.Body {
 			err := n.Compile(ctx, CompileEmit)
@@ -578,10 +1121,34 @@ func (n *ForNode) compileEmit(ctx *CompileContext) error {
 	}
 
 	ctx.pushInstr(jump, nextIndex-len(ctx.code)-1, "")
+	exitIndex := len(ctx.code)
+	ctx.code[nextIndex].iarg = exitIndex - nextIndex - 1
+	altJump := -1
+	if n.Alt != nil {
+		ctx.pushInstr(jumpIterNotEmpty, 0, "")
+		ctx.pushInstr(discardIter, 0, "")
+		// the else body does not see the loop variables
+		ctx.EndScope()
+		ctx.BeginScope()
+		for _, n := range n.Alt {
+			err := n.Compile(ctx, CompileEmit)
+			if err != nil {
+				return err
+			}
+		}
+		ctx.EndScope()
+		altJump = len(ctx.code)
+		ctx.pushInstr(jump, 0, "")
+		ctx.code[exitIndex].iarg = len(ctx.code) - exitIndex - 1
+	}
 	endIndex := len(ctx.code)
-	ctx.code[nextIndex].iarg = endIndex - nextIndex - 1
 	ctx.pushInstr(discardIter, 0, "")
-	ctx.EndScope()
+	if altJump >= 0 {
+		ctx.pushInstr(endScope, 0, "")
+		ctx.code[altJump].iarg = len(ctx.code) - altJump - 1
+	} else {
+		ctx.EndScope()
+	}
 
 	// update the loop labels
 	for _, jmp := range loopJumps {
@@ -594,10 +1161,160 @@ func (n *ForNode) compileEmit(ctx *CompileContext) error {
 	}
 	return nil
 }
+
 func (n *ForNode) Compile(ctx *CompileContext, mode int) error {
 	switch mode {
 	case CompilePush:
-		subprog, err := ctx.WithSubprog(nil, func() error { return n.compileEmit(ctx) })
+		subprog, err := ctx.withInlineSubprog(func() error { return n.compileEmit(ctx) })
+		if err != nil {
+			return err
+		}
+		ctx.CallSubprogNA(mode, subprog)
+		return nil
+	case CompileEmit:
+		return n.compileEmit(ctx)
+	default:
+		return nil
+	}
+}
+
+// compileEmit compiles the loop
+//
+//	        beginScope
+//	next:   <cond>
+//	        jumpFalse exit
+//	        discardPop
+//	        loopGuard
+//	        <body>
+//	        jump next
+//	exit:   discardPop
+//	end:    endScope
+//
+// The iteration count of loopGuard is kept in an unnamed local.
+func (n *WhileNode) compileEmit(ctx *CompileContext) error {
+	var loopJumps []loopJump
+
+	ctx.BeginScope()
+	counter := ctx.frame.push("")
+	ctx.pushInstr(clearLocal, counter, "")
+	ctx.hoistLocals(n.Body)
+
+	nextIndex := len(ctx.code)
+	err := n.Cond.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	exitJump := len(ctx.code)
+	ctx.pushInstr(jumpFalse, 0, "")
+	ctx.pushInstr(discardPop, 0, "")
+	ctx.SetPos(n.Pos)
+	ctx.pushInstr(loopGuard, counter, "")
+
+	err = ctx.WithLoopJumps(&loopJumps, func() error {
+		for _, n := range n.Body {
+			err := n.Compile(ctx, CompileEmit)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.pushInstr(jump, nextIndex-len(ctx.code)-1, "")
+	ctx.code[exitJump].iarg = len(ctx.code) - exitJump - 1
+	ctx.pushInstr(discardPop, 0, "")
+	endIndex := len(ctx.code)
+	ctx.EndScope()
+
+	for _, jmp := range loopJumps {
+		switch jmp.kind {
+		case loopJumpNext:
+			ctx.code[jmp.idx].iarg = nextIndex - jmp.idx - 1
+		case loopJumpEnd:
+			ctx.code[jmp.idx].iarg = endIndex - jmp.idx - 1
+		}
+	}
+	return nil
+}
+
+func (n *WhileNode) Compile(ctx *CompileContext, mode int) error {
+	switch mode {
+	case CompilePush:
+		subprog, err := ctx.withInlineSubprog(func() error { return n.compileEmit(ctx) })
+		if err != nil {
+			return err
+		}
+		ctx.CallSubprogNA(mode, subprog)
+		return nil
+	case CompileEmit:
+		return n.compileEmit(ctx)
+	default:
+		return nil
+	}
+}
+
+func (n *TryNode) compileEmit(ctx *CompileContext) error {
+	loop := ctx.loop
+	var signals []loopJump
+	body, err := ctx.withInlineSubprog(func() error {
+		if loop != nil {
+			ctx.loop = &loopScope{jumps: &signals, signal: true}
+		}
+		return compileNodes(ctx, n.Body, CompileEmit)
+	})
+	if err != nil {
+		return err
+	}
+	ctx.SetPos(n.Pos)
+	ctx.pushInstr(emitTry, body, "")
+	successJump := len(ctx.code)
+	ctx.pushInstr(jumpNil, 0, "")
+
+	ctx.BeginScope()
+	if n.Var != "" {
+		ctx.Declare(n.Var)
+	} else {
+		ctx.pushInstr(discardPop, 0, "")
+	}
+	err = compileNodes(ctx, n.Catch, CompileEmit)
+	if err != nil {
+		return err
+	}
+	ctx.EndScope()
+	endJump := len(ctx.code)
+	ctx.pushInstr(jump, 0, "")
+
+	ctx.code[successJump].iarg = len(ctx.code) - successJump - 1
+	ctx.pushInstr(discardPop, 0, "")
+
+	// continue a break or continue that left the body
+	for _, kind := range []int{loopJumpNext, loopJumpEnd} {
+		if !slices.ContainsFunc(signals, func(j loopJump) bool { return j.kind == kind }) {
+			continue
+		}
+		ctx.pushInstr(pushLoopSignal, kind, "")
+		nextJump := len(ctx.code)
+		ctx.pushInstr(jumpFalse, 0, "")
+		ctx.pushInstr(discardPop, 0, "")
+		err = ctx.jumpLoop(kind)
+		if err != nil {
+			return err
+		}
+		ctx.code[nextJump].iarg = len(ctx.code) - nextJump - 1
+		ctx.pushInstr(discardPop, 0, "")
+	}
+
+	ctx.code[endJump].iarg = len(ctx.code) - endJump - 1
+	return nil
+}
+
+func (n *TryNode) Compile(ctx *CompileContext, mode int) error {
+	switch mode {
+	case CompilePush:
+		subprog, err := ctx.withInlineSubprog(func() error { return n.compileEmit(ctx) })
 		if err != nil {
 			return err
 		}
@@ -612,17 +1329,172 @@ func (n *ForNode) Compile(ctx *CompileContext, mode int) error {
 
 func (n *IncludeNode) Compile(ctx *CompileContext, mode int) error {
 	if name, ok := n.Name.(*ValueNode); ok {
+		ctx.SetPos(n.Pos)
 		ctx.IncludeTemplate(mode, name.Value)
 	} else {
 		err := n.Name.Compile(ctx, CompilePush)
 		if err != nil {
 			return err
 		}
+		ctx.SetPos(n.Pos)
 		ctx.IncludeTemplateDyn(mode)
 	}
 	return nil
 }
 
+func (n *ImportNode) Compile(ctx *CompileContext, mode int) error {
+	err := n.Name.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	ctx.SetPos(n.Pos)
+	ctx.pushInstr(pushImport, 0, "")
+	if n.As != "" {
+		ctx.Declare(n.As)
+		return nil
+	}
+	for _, name := range n.Names {
+		ctx.PushPeek()
+		ctx.Attr(CompilePush, name)
+		ctx.Declare(name)
+	}
+	ctx.DiscardPop()
+	return nil
+}
+
+func (n *ExtendsNode) Compile(ctx *CompileContext, mode int) error {
+	if ctx.extends != nil || !ctx.frame.dynamic() || ctx.scopes != 0 || ctx.filters != 0 {
+		return fmt.Errorf("extends %s: %w", n.Template, ErrExtends)
+	}
+	ctx.extends = n
+	// the output of the rest of the template is replaced by the parent
+	ctx.PushOutputFilter(DiscardFilter)
+	return nil
+}
+
+// Link resolves the parent templates of the templates using extends and
+// the blocks their super refers to. Compile links as well, but ignores
+// the errors, which then happen when the templates are rendered.
+func (c *CompileContext) Link() error {
+	names := make([]string, 0, len(c.templates))
+	for name, tpl := range c.templates {
+		if tpl.Extends != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		tpl := c.templates[name]
+		extends := &tpl.Code[len(tpl.Code)-1]
+		if extends.iarg >= 0 {
+			continue // linked already
+		}
+		err := c.linkSuper(name, tpl.Extends)
+		if err != nil {
+			return fmt.Errorf("link template '%s': %w", name, err)
+		}
+		idx, err := c.linkParent(tpl.Extends, tpl.Blocks, []string{name})
+		if err != nil {
+			return fmt.Errorf("link template '%s': %w", name, err)
+		}
+		extends.iarg = idx
+	}
+	return nil
+}
+
+// linkSuper sets the blocks of parent that are referred to by super in
+// the subprogs of template.
+func (c *CompileContext) linkSuper(template, parent string) error {
+	for i := range c.subprogs {
+		if c.subprogs[i].Template != template {
+			continue
+		}
+		code := c.subprogs[i].Code
+		for j := range code {
+			if code[j].op != pushSuper || code[j].iarg >= 0 {
+				continue
+			}
+			idx, err := c.parentBlock(parent, code[j].sarg, []string{template})
+			if err != nil {
+				return err
+			}
+			code[j].iarg = idx
+		}
+	}
+	return nil
+}
+
+// parentBlock returns the subprog of the block name that template declares
+// or inherits.
+func (c *CompileContext) parentBlock(template, name string, chain []string) (int, error) {
+	for _, t := range chain {
+		if t == template {
+			return 0, fmt.Errorf("'%s': %w", template, ErrExtendsCycle)
+		}
+	}
+	tpl, ok := c.templates[template]
+	if !ok {
+		return 0, fmt.Errorf("'%s': %w", template, ErrParentNotFound)
+	}
+	if idx, ok := tpl.Blocks[name]; ok {
+		return idx, nil
+	}
+	if tpl.Extends == "" {
+		return 0, fmt.Errorf("block '%s': %w", name, ErrSuperNotFound)
+	}
+	return c.parentBlock(tpl.Extends, name, append(chain, template))
+}
+
+// linkParent adds a subprog that renders template with the blocks in
+// overrides declared instead of its own ones and returns its index.
+// chain are the templates extending template, for detecting cycles.
+func (c *CompileContext) linkParent(template string, overrides map[string]int, chain []string) (int, error) {
+	for _, t := range chain {
+		if t == template {
+			return 0, fmt.Errorf("'%s': %w", template, ErrExtendsCycle)
+		}
+	}
+	tpl, ok := c.templates[template]
+	if !ok {
+		return 0, fmt.Errorf("'%s': %w", template, ErrParentNotFound)
+	}
+
+	remap := map[int]int{}
+	for name, idx := range tpl.Blocks {
+		if override, ok := overrides[name]; ok {
+			remap[idx] = override
+		}
+	}
+	code := append([]Instr(nil), tpl.Code...)
+	for i := range code {
+		if code[i].op != pushSubprog {
+			continue
+		}
+		if idx, ok := remap[code[i].iarg]; ok {
+			code[i].iarg = idx
+		}
+	}
+
+	if tpl.Extends != "" {
+		blocks := make(map[string]int, len(tpl.Blocks)+len(overrides))
+		for name, idx := range tpl.Blocks {
+			blocks[name] = idx
+		}
+		for name, idx := range overrides {
+			blocks[name] = idx
+		}
+		idx, err := c.linkParent(tpl.Extends, blocks, append(chain, template))
+		if err != nil {
+			return 0, err
+		}
+		code[len(code)-1].iarg = idx
+	}
+
+	c.subprogs = append(c.subprogs, Subprog{Code: code, Template: template, Slots: tpl.Slots})
+	return len(c.subprogs) - 1, nil
+}
+
 type discardFilter struct{}
 
 var DiscardFilter ValueFilter = discardFilter{}
@@ -633,7 +1505,10 @@ func (discardFilter) Filter(s string) (string, error) {
 
 func (n *DiscardNode) Compile(ctx *CompileContext, mode int) error {
 	ctx.PushOutputFilter(DiscardFilter)
-	compileNodes(ctx, n.Body, mode)
+	err := compileNodes(ctx, n.Body, mode)
+	if err != nil {
+		return err
+	}
 	ctx.PopOutputFilter()
 	return nil
 }
@@ -649,11 +1524,21 @@ func (n *ObjectNode) Compile(ctx *CompileContext, mode int) error {
 		ctx.pushInstr(extendObject, 0, "")
 	}
 	for _, key := range n.Keys {
+		if key.KeyExpr != nil {
+			err := key.KeyExpr.Compile(ctx, CompilePush)
+			if err != nil {
+				return err
+			}
+		}
 		err := key.Value.Compile(ctx, CompilePush)
 		if err != nil {
 			return err
 		}
-		ctx.pushInstr(assignKey, 0, key.Key)
+		if key.KeyExpr != nil {
+			ctx.pushInstr(assignKeyDyn, 0, "")
+		} else {
+			ctx.pushInstr(assignKey, 0, key.Key)
+		}
 	}
 
 	if mode == CompileEmit {
@@ -662,6 +1547,21 @@ func (n *ObjectNode) Compile(ctx *CompileContext, mode int) error {
 	return nil
 }
 
+func (n *ListNode) Compile(ctx *CompileContext, mode int) error {
+	for _, item := range n.Items {
+		err := item.Compile(ctx, CompilePush)
+		if err != nil {
+			return err
+		}
+	}
+	ctx.pushInstr(pushList, len(n.Items), "")
+
+	if mode == CompileEmit {
+		ctx.pushInstr(emitPop, 0, "")
+	}
+	return nil
+}
+
 func (n *NilNode) Compile(ctx *CompileContext, mode int) error {
 	ctx.Nil(mode)
 	return nil
@@ -695,3 +1595,32 @@ func (n *ThenNode) Compile(ctx *CompileContext, mode int) error {
 	ctx.code[jumpEndIdx].iarg = endIdx - jumpEndIdx - 1
 	return nil
 }
+
+func (n *BreakNode) Compile(ctx *CompileContext, mode int) error {
+	err := ctx.jumpLoop(loopJumpEnd)
+	if err != nil {
+		return fmt.Errorf("compile break: %w", err)
+	}
+	return nil
+}
+
+func (n *ContinueNode) Compile(ctx *CompileContext, mode int) error {
+	err := ctx.jumpLoop(loopJumpNext)
+	if err != nil {
+		return fmt.Errorf("compile continue: %w", err)
+	}
+	return nil
+}
+
+func (n *ReturnNode) Compile(ctx *CompileContext, mode int) error {
+	if ctx.frame.template {
+		return fmt.Errorf("compile return: %w", ErrReturn)
+	}
+	err := n.Value.Compile(ctx, CompilePush)
+	if err != nil {
+		return err
+	}
+	ctx.SetPos(n.Pos)
+	ctx.pushInstr(returnPop, 0, "")
+	return nil
+}
@@ -0,0 +1,286 @@
+package tplexpr
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var opNames = [opCount]string{
+	emit:              "emit",
+	push:              "push",
+	emitFetch:         "emitFetch",
+	pushFetch:         "pushFetch",
+	emitCall:          "emitCall",
+	pushCall:          "pushCall",
+	emitCallDyn:       "emitCallDyn",
+	pushCallDyn:       "pushCallDyn",
+	emitCallSubprogNA: "emitCallSubprogNA",
+	pushCallSubprogNA: "pushCallSubprogNA",
+	emitAttr:          "emitAttr",
+	pushAttr:          "pushAttr",
+	emitSubprog:       "emitSubprog",
+	pushSubprog:       "pushSubprog",
+	emitCompare:       "emitCompare",
+	pushCompare:       "pushCompare",
+	jump:              "jump",
+	jumpTrue:          "jumpTrue",
+	jumpFalse:         "jumpFalse",
+	emitPop:           "emitPop",
+	discardPop:        "discardPop",
+	storePop:          "storePop",
+	declarePop:        "declarePop",
+	pushPeek:          "pushPeek",
+	emitNot:           "emitNot",
+	pushNot:           "pushNot",
+	emitBinaryOP:      "emitBinaryOP",
+	pushBinaryOP:      "pushBinaryOP",
+	emitNumber:        "emitNumber",
+	pushNumber:        "pushNumber",
+	emitNil:           "emitNil",
+	pushNil:           "pushNil",
+	pushIter:          "pushIter",
+	iterNextOrJump:    "iterNextOrJump",
+	discardIter:       "discardIter",
+	beginScope:        "beginScope",
+	endScope:          "endScope",
+	pushOutputFilter:  "pushOutputFilter",
+	popOutputFilter:   "popOutputFilter",
+	emitTemplate:      "emitTemplate",
+	pushTemplate:      "pushTemplate",
+	emitTemplateDyn:   "emitTemplateDyn",
+	pushTemplateDyn:   "pushTemplateDyn",
+	assignKey:         "assignKey",
+	assignKeyDyn:      "assignKeyDyn",
+	pushObject:        "pushObject",
+	extendObject:      "extendObject",
+	emitLocal:         "emitLocal",
+	pushLocal:         "pushLocal",
+	declareLocal:      "declareLocal",
+	clearLocal:        "clearLocal",
+	exportLocal:       "exportLocal",
+	pushList:          "pushList",
+	emitIndex:         "emitIndex",
+	pushIndex:         "pushIndex",
+	emitSlice:         "emitSlice",
+	pushSlice:         "pushSlice",
+	emitNeg:           "emitNeg",
+	pushNeg:           "pushNeg",
+	jumpNil:           "jumpNil",
+	jumpNotNil:        "jumpNotNil",
+	loopGuard:         "loopGuard",
+	unpack:            "unpack",
+	pushLoop:          "pushLoop",
+	jumpIterNotEmpty:  "jumpIterNotEmpty",
+	emitExtends:       "emitExtends",
+	pushSuper:         "pushSuper",
+	pushImport:        "pushImport",
+	emitCallMethod:    "emitCallMethod",
+	pushCallMethod:    "pushCallMethod",
+	pushNamedArgs:     "pushNamedArgs",
+	returnPop:         "returnPop",
+	emitTry:           "emitTry",
+	signalLoop:        "signalLoop",
+	pushLoopSignal:    "pushLoopSignal",
+}
+
+var compareNames = []string{EQ: "==", NE: "!=", GT: ">", GE: ">=", LT: "<", LE: "<=", IN: "in", NOTIN: "not in"}
+
+var binaryOPNames = []string{ADD: "+", SUB: "-", MUL: "*", DIV: "/", MOD: "%", FLOORDIV: "//", POW: "**"}
+
+// Op returns the name of the opcode of i.
+func (i Instr) Op() string {
+	if i.op >= 0 && i.op < len(opNames) {
+		return opNames[i.op]
+	}
+	return "op(" + strconv.Itoa(i.op) + ")"
+}
+
+// IntArg returns the integer argument of i. Its meaning depends on the
+// opcode, e.g. it is the relative offset of jumps.
+func (i Instr) IntArg() int {
+	return i.iarg
+}
+
+// StringArg returns the string argument of i.
+func (i Instr) StringArg() string {
+	return i.sarg
+}
+
+// Pos returns the source position i was compiled from.
+func (i Instr) Pos() Pos {
+	return i.pos
+}
+
+func nameAt(names []string, i int) string {
+	if i >= 0 && i < len(names) && names[i] != "" {
+		return names[i]
+	}
+	return "?" + strconv.Itoa(i)
+}
+
+func filterName(f ValueFilter) string {
+	if name, ok := lookupFilterName(f); ok {
+		return name
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+// disassembler formats code. The filters are used to print the names of
+// output filters, they may be nil.
+type disassembler struct {
+	w       io.Writer
+	filters []ValueFilter
+	err     error
+}
+
+func (d *disassembler) printf(format string, args ...any) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+func (d *disassembler) arg(ip int, instr Instr) string {
+	switch instr.op {
+	case emit, push:
+		return strconv.Quote(instr.sarg)
+	case emitCall, pushCall, emitCallMethod, pushCallMethod:
+		return fmt.Sprintf("%s argc=%d", instr.sarg, instr.iarg)
+	case emitCallDyn, pushCallDyn:
+		return fmt.Sprintf("argc=%d", instr.iarg)
+	case pushList, unpack:
+		return fmt.Sprintf("len=%d", instr.iarg)
+	case emitCallSubprogNA, pushCallSubprogNA, emitSubprog, pushSubprog, emitTry:
+		return fmt.Sprintf("subprog %d", instr.iarg)
+	case emitExtends, pushSuper:
+		return fmt.Sprintf("subprog %d (%s)", instr.iarg, instr.sarg)
+	case emitCompare, pushCompare:
+		return nameAt(compareNames, instr.iarg)
+	case emitBinaryOP, pushBinaryOP:
+		return nameAt(binaryOPNames, instr.iarg)
+	case jump, jumpTrue, jumpFalse, jumpNil, jumpNotNil, jumpIterNotEmpty:
+		return fmt.Sprintf("-> %04d", ip+1+instr.iarg)
+	case iterNextOrJump:
+		return fmt.Sprintf("%s, -> %04d", instr.sarg, ip+1+instr.iarg)
+	case emitLocal, pushLocal, declareLocal, clearLocal, exportLocal, loopGuard:
+		if instr.iarg < 0 {
+			return fmt.Sprintf("capture %d (%s)", -instr.iarg-1, instr.sarg)
+		}
+		return fmt.Sprintf("slot %d (%s)", instr.iarg, instr.sarg)
+	case emitAttr, pushAttr:
+		if instr.iarg != 0 {
+			return "?." + instr.sarg
+		}
+		return instr.sarg
+	case signalLoop, pushLoopSignal:
+		if instr.iarg == loopJumpEnd {
+			return "break"
+		}
+		return "continue"
+	case pushOutputFilter:
+		if instr.iarg >= 0 && instr.iarg < len(d.filters) {
+			return fmt.Sprintf("filter %d (%s)", instr.iarg, filterName(d.filters[instr.iarg]))
+		}
+		return fmt.Sprintf("filter %d", instr.iarg)
+	}
+	return instr.sarg
+}
+
+func (d *disassembler) code(code []Instr) {
+	for ip, instr := range code {
+		pos := ""
+		if instr.pos.Line > 0 {
+			pos = instr.pos.String()
+		}
+		arg := d.arg(ip, instr)
+		if arg == "" {
+			d.printf("%04d  %-7s  %s\n", ip, pos, instr.Op())
+		} else {
+			d.printf("%04d  %-7s  %-18s %s\n", ip, pos, instr.Op(), arg)
+		}
+	}
+}
+
+func (d *disassembler) program(templates map[string]Template, subprogs []Subprog) {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d.printf("template %s", strconv.Quote(name))
+		if slots := templates[name].Slots; slots > 0 {
+			d.printf(" slots=%d", slots)
+		}
+		d.printf(":\n")
+		d.code(templates[name].Code)
+		d.printf("\n")
+	}
+	for i, subprog := range subprogs {
+		d.printf("subprog %d", i)
+		if subprog.Name != "" {
+			d.printf(" %s", subprog.Name)
+		}
+		d.printf("(%s)", strings.Join(subprogParams(subprog), ", "))
+		if subprog.Template != "" {
+			d.printf(" in %s", strconv.Quote(subprog.Template))
+		}
+		if subprog.Inline {
+			d.printf(" inline")
+		} else if subprog.Slots > 0 {
+			d.printf(" slots=%d", subprog.Slots)
+		}
+		for _, from := range subprog.Captures {
+			if from < 0 {
+				d.printf(" capture(%d)", -from-1)
+			} else {
+				d.printf(" capture(slot %d)", from)
+			}
+		}
+		d.printf(":\n")
+		d.code(subprog.Code)
+		d.printf("\n")
+	}
+}
+
+// Disassemble writes a listing of code to w, one instruction per line.
+func Disassemble(w io.Writer, code []Instr) error {
+	d := disassembler{w: w}
+	d.code(code)
+	return d.err
+}
+
+// Disassemble writes a listing of all templates and subprogs compiled by
+// c to w.
+func (c *CompileContext) Disassemble(w io.Writer) error {
+	d := disassembler{w: w, filters: c.valueFilters}
+	d.program(c.templates, c.subprogs)
+	return d.err
+}
+
+// Disassemble writes a listing of all templates and subprogs of c to w.
+func (c *Context) Disassemble(w io.Writer) error {
+	d := disassembler{w: w, filters: c.valueFilters}
+	d.program(c.templates, c.subprogs)
+	return d.err
+}
+
+// subprogParams formats the parameters of subprog. Parameters with a
+// default value name the subprog computing it.
+func subprogParams(subprog Subprog) []string {
+	params := append([]string(nil), subprog.Args...)
+	required := len(params) - len(subprog.Defaults)
+	for i, def := range subprog.Defaults {
+		params[required+i] += fmt.Sprintf("=subprog %d", def)
+	}
+	if subprog.Rest != "" {
+		params = append(params, "..."+subprog.Rest)
+	}
+	if subprog.Kwargs != "" {
+		params = append(params, "**"+subprog.Kwargs)
+	}
+	return params
+}
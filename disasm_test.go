@@ -0,0 +1,110 @@
+package tplexpr
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOpNames(t *testing.T) {
+	for op, name := range opNames {
+		if name == "" {
+			t.Errorf("opcode %d has no name", op)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("main.txt", []byte(`Hi ${if x > 1 then block(b, y) y endblock endif discard b(x) enddiscard}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `template "main.txt" slots=1:
+0000           emit               "Hi "
+0001  1:9      pushFetch          x
+0002  1:9      pushNumber         1
+0003  1:11     pushCompare        >
+0004  1:11     jumpFalse          -> 0011
+0005  1:11     beginScope
+0006  1:11     discardPop
+0007  1:32     pushSubprog        subprog 0
+0008  1:32     declareLocal       slot 0 (b)
+0009  1:32     endScope
+0010  1:32     jump               -> 0014
+0011  1:32     discardPop
+0012  1:32     beginScope
+0013  1:32     endScope
+0014  1:32     pushOutputFilter   filter 0 (discard)
+0015  1:59     pushFetch          x
+0016  1:57     emitCall           b argc=1
+0017  1:57     popOutputFilter
+
+subprog 0 b(y) in "main.txt" slots=1:
+0000  1:32     emitLocal          slot 0 (y)
+
+`
+
+	sb := strings.Builder{}
+	err = cc.Disassemble(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, sb.String())
+	}
+}
+
+func TestStoreDisassemble(t *testing.T) {
+	store, err := BuildStore().
+		AddFS(fstest.MapFS{"a.txt": {Data: []byte(`${include('b.txt')}`)}, "b.txt": {Data: []byte(`b`)}}, "*.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb := strings.Builder{}
+	err = store.Disassemble(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `template "a.txt":
+0000  1:3      emitTemplate       b.txt
+
+template "b.txt":
+0000           emit               "b"
+
+`
+	if sb.String() != expected {
+		t.Errorf("expected:\n%s\nfound:\n%s", expected, sb.String())
+	}
+}
+
+func TestIfPopsSkippedCondition(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("main.txt", []byte(`${if a then 1 elseif b then 2 endif}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// jumpFalse peeks the condition, so the branch it jumps to has to pop
+	// it, otherwise it is left on the stack
+	code := cc.templates["main.txt"].Code
+	jumps := 0
+	for i, instr := range code {
+		if instr.Op() != "jumpFalse" {
+			continue
+		}
+		jumps++
+		target := i + 1 + instr.IntArg()
+		if target >= len(code) || code[target].Op() != "discardPop" {
+			sb := strings.Builder{}
+			Disassemble(&sb, code)
+			t.Errorf("jumpFalse at %04d does not jump to discardPop:\n%s", i, sb.String())
+		}
+	}
+	if jumps != 2 {
+		t.Errorf("expected 2 jumpFalse instructions, found %d", jumps)
+	}
+}
@@ -1,64 +1,152 @@
 package tplexpr
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 type Subprog struct {
-	Args []string
-	Code []Instr
+	Args     []string
+	Defaults []int  // inline subprogs computing the last len(Defaults) args
+	Rest     string // collects the extra positional args
+	Kwargs   string // collects the extra named args
+	Code     []Instr
+	Name     string
+	Template string
+	Slots    int   // size of the frame
+	Captures []int // locals of the enclosing frame copied on creation
+	Inline   bool  // runs in the frame of the caller
 }
 
 type Context struct {
-	vars             map[string]varValue
-	shadowed         []shadowedVar
-	scope            int
-	prevScopes       []int
+	env              *env
+	scopes           []*env
+	globals          map[string]Value
 	subprogs         []Subprog
-	iters            []ValueIter
+	iters            []*loopState
 	valueFilters     []ValueFilter
 	outputFilters    []ValueFilter
 	templates        map[string]Template
+	frame            []Value
+	captures         []Value
+	slots            []Value
+	exec             *execState
+	imports          *importState
+	loopSignal       *loopSignal // left a try body, continued after the try
+	Limits           Limits
 	NameError        func(name string) (Value, error)
 	TemplateNotFound func(name string) error
 }
 
 func NewContext() Context {
-	return Context{
-		vars: map[string]varValue{},
-	}
+	return Context{}
 }
 
+// Clone returns a Context that sees the variables of c at the time of the
+// call. Declarations in either Context are not visible in the other one.
 func (c *Context) Clone() *Context {
 	clone := NewContext()
-	for name, value := range c.vars {
-		clone.vars[name] = value
-	}
+	clone.env = c.env
+	clone.globals = c.globals
 	clone.subprogs = c.subprogs
 	clone.valueFilters = c.valueFilters
 	clone.templates = c.templates
+	clone.exec = c.exec
+	clone.imports = c.imports
+	clone.Limits = c.Limits
 	clone.NameError = c.NameError
 	clone.TemplateNotFound = c.TemplateNotFound
 	return &clone
 }
 
-type shadowedVar struct {
+// reset clears the render state of c, so it can be reused for another
+// render of the same program.
+func (c *Context) reset() {
+	clear(c.scopes)
+	clear(c.iters)
+	clear(c.outputFilters)
+	clear(c.slots)
+	c.env = nil
+	c.scopes = c.scopes[:0]
+	c.iters = c.iters[:0]
+	c.outputFilters = c.outputFilters[:0]
+	c.slots = c.slots[:0]
+	c.frame = nil
+	c.captures = nil
+	c.exec = nil
+	c.imports = nil
+	c.loopSignal = nil
+}
+
+// cancelCheckInterval is the number of instructions executed between two
+// checks for the cancellation of the render.
+const cancelCheckInterval = 1024
+
+// execState is the state of a single render. It is shared by all
+// Contexts cloned during the render.
+type execState struct {
+	ctx    context.Context
+	limits Limits
+	steps  int
+	depth  int
+	output int
+}
+
+func (e *execState) step() error {
+	e.steps++
+	if e.limits.MaxInstructions > 0 && e.steps > e.limits.MaxInstructions {
+		return limitError("max instructions", e.limits.MaxInstructions)
+	}
+	if e.steps%cancelCheckInterval == 0 {
+		return e.ctx.Err()
+	}
+	return nil
+}
+
+// goContext returns the context.Context of the render, or
+// context.Background() if c is not evaluated in a render.
+func (c *Context) goContext() context.Context {
+	if c.exec == nil {
+		return context.Background()
+	}
+	return c.exec.ctx
+}
+
+// env is an immutable chain of the dynamic variables of a Context, newest
+// first. A node either holds a single variable or a map of variables (the
+// vars of a render). Since nodes are never modified, closures share the env
+// they were created in instead of copying it.
+type env struct {
 	name  string
 	value Value
-	scope int
+	vars  Vars
+	next  *env
 }
 
-type varValue struct {
-	value Value
-	scope int
+func (e *env) lookup(name string) (Value, bool) {
+	for ; e != nil; e = e.next {
+		if e.vars != nil {
+			if value, ok := e.vars[name]; ok {
+				return value, true
+			}
+		} else if e.name == name {
+			return e.value, true
+		}
+	}
+	return nil, false
 }
 
 func (c *Context) TryLookup(name string) (Value, bool) {
-	v, ok := c.vars[name]
-	return v.value, ok
+	value, ok := c.env.lookup(name)
+	if !ok {
+		value, ok = c.globals[name]
+	}
+	return value, ok
 }
 
 type ErrName struct {
@@ -69,6 +157,178 @@ func (e *ErrName) Error() string {
 	return fmt.Sprintf("name '%s' is not defined", e.Name)
 }
 
+// ErrRaised is returned by the error builtin to fail a render deliberately.
+type ErrRaised struct {
+	Message string
+	Kind    string
+}
+
+func (e *ErrRaised) Error() string {
+	return e.Message
+}
+
+// catchable reports whether a try may handle err. Exceeded limits and
+// canceled renders can not be caught.
+func catchable(err error) bool {
+	return !errors.Is(err, ErrLimitExceeded) &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded)
+}
+
+func errorKind(err error) string {
+	var (
+		raised *ErrRaised
+		name   *ErrName
+		typ    *ErrType
+	)
+	switch {
+	case errors.As(err, &raised):
+		return raised.Kind
+	case errors.As(err, &name):
+		return "name"
+	case errors.As(err, &typ):
+		return "type"
+	case errors.Is(err, ErrIndexOutOfRange):
+		return "index"
+	case errors.Is(err, ErrDivisionByZero):
+		return "division"
+	case errors.Is(err, ErrArgMissing), errors.Is(err, ErrArgDuplicate), errors.Is(err, ErrArgUnknown):
+		return "argument"
+	}
+	return "error"
+}
+
+// errorObject returns the object a catch branch gets for err, which
+// failed in template unless it has frames of its own.
+func errorObject(err error, template string) Value {
+	obj := ObjectValue{
+		"kind":     StringValue(errorKind(err)),
+		"template": StringValue(template),
+		"position": Nil,
+		"line":     Nil,
+		"column":   Nil,
+	}
+	message := err
+	var e *RenderError
+	if errors.As(err, &e) {
+		message = e.Err
+		if len(e.Frames) > 0 {
+			f := e.Frames[0]
+			if f.Template != "" {
+				obj["template"] = StringValue(f.Template)
+			}
+			obj["position"] = StringValue(f.Pos.String())
+			obj["line"] = NumberValue(f.Pos.Line)
+			obj["column"] = NumberValue(f.Pos.Column)
+		}
+	}
+	obj["message"] = StringValue(message.Error())
+	return obj
+}
+
+// Frame is a single entry of the template call stack of a RenderError.
+type Frame struct {
+	Template string
+	Name     string // name of the block, empty for templates and lambdas
+	Pos      Pos
+}
+
+func (f Frame) String() string {
+	sb := strings.Builder{}
+	if f.Template != "" {
+		sb.WriteString(f.Template)
+		sb.WriteByte(':')
+	}
+	sb.WriteString(f.Pos.String())
+	if f.Name != "" {
+		sb.WriteString(" in ")
+		sb.WriteString(f.Name)
+	}
+	return sb.String()
+}
+
+// RenderError is returned if the evaluation of a template fails. Frames
+// holds the template call stack, starting with the innermost frame.
+type RenderError struct {
+	Err    error
+	Frames []Frame
+
+	// the innermost frame has a position but does not know the
+	// template or block it belongs to yet
+	open bool
+}
+
+func (e *RenderError) Error() string {
+	if len(e.Frames) == 0 {
+		return e.Err.Error()
+	}
+	sb := strings.Builder{}
+	sb.WriteString(e.Frames[0].String())
+	sb.WriteString(": ")
+	sb.WriteString(e.Err.Error())
+	for _, f := range e.Frames[1:] {
+		sb.WriteString("\n\tfrom ")
+		sb.WriteString(f.String())
+	}
+	return sb.String()
+}
+
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// errorAt records pos as the position of the failing instruction. If the
+// error already has a position for the current code unit (from a subprog
+// that was evaluated inline), it is kept. The frames of a RenderError a
+// builtin wrapped (e.g. the error of a callback) are continued.
+func errorAt(err error, pos Pos) error {
+	var e *RenderError
+	if errors.As(err, &e) {
+		if err != e {
+			e = &RenderError{Err: newWrappedError(err, e), Frames: e.Frames, open: e.open}
+		}
+		if !e.open {
+			e.Frames = append(e.Frames, Frame{Pos: pos})
+			e.open = true
+		}
+		return e
+	}
+	return &RenderError{Err: err, Frames: []Frame{{Pos: pos}}, open: true}
+}
+
+// wrappedError keeps the context a builtin added to the RenderError of a
+// callback, whose frames moved to the RenderError of the builtin call.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func newWrappedError(err error, e *RenderError) *wrappedError {
+	// the frames are reported by the outer RenderError
+	msg := strings.Replace(err.Error(), e.Error(), e.Err.Error(), 1)
+	return &wrappedError{msg: msg, err: err}
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// closeFrame sets the template and block name of the innermost frame.
+func closeFrame(err error, template, name string) error {
+	var e *RenderError
+	if errors.As(err, &e) && e.open {
+		f := &e.Frames[len(e.Frames)-1]
+		f.Template = template
+		f.Name = name
+		e.open = false
+	}
+	return err
+}
+
 func (c *Context) Lookup(name string) (value Value, err error) {
 	value, ok := c.TryLookup(name)
 	if !ok {
@@ -82,42 +342,117 @@ func (c *Context) Lookup(name string) (value Value, err error) {
 }
 
 func (c *Context) Declare(name string, value Value) {
-	v, ok := c.vars[name]
-	if !ok || v.scope != c.scope {
-		c.shadowed = append(c.shadowed, shadowedVar{name, v.value, v.scope})
+	c.env = &env{name: name, value: value, next: c.env}
+}
+
+// redeclare is like Declare, but replaces a declaration of name in the
+// current scope instead of shadowing it, so declaring the same name over
+// and over does not grow the env.
+func (c *Context) redeclare(name string, value Value) {
+	var end *env
+	if len(c.scopes) > 0 {
+		end = c.scopes[len(c.scopes)-1]
 	}
-	c.vars[name] = varValue{value, c.scope}
+
+	var path []*env
+	e := c.env
+	for ; e != nil && e != end; e = e.next {
+		if e.vars != nil {
+			if _, ok := e.vars[name]; ok {
+				break
+			}
+		} else if e.name == name {
+			break
+		}
+		path = append(path, e)
+	}
+	if e == nil || e == end || e.vars != nil {
+		c.Declare(name, value)
+		return
+	}
+
+	replaced := &env{name: name, value: value, next: e.next}
+	for i := len(path) - 1; i >= 0; i-- {
+		copied := *path[i]
+		copied.next = replaced
+		c.relink(path[i], &copied)
+		replaced = &copied
+	}
+	c.env = replaced
 }
 
-func (c *Context) Assign(name string, value Value) {
-	v, ok := c.vars[name]
-	if ok {
-		c.vars[name] = varValue{value, v.scope}
-	} else {
-		c.shadowed = append(c.shadowed, shadowedVar{name, v.value, v.scope})
-		c.vars[name] = varValue{value, c.scope}
+// declareVars declares all vars in a single env node.
+func (c *Context) declareVars(vars Vars) {
+	if len(vars) == 0 {
+		return
 	}
+	copied := make(Vars, len(vars))
+	for name, value := range vars {
+		copied[name] = value
+	}
+	c.env = &env{vars: copied, next: c.env}
 }
 
-func (c *Context) BeginScope() {
-	c.prevScopes = append(c.prevScopes, c.scope)
-	c.scope = len(c.shadowed)
+// Assign sets the variable name in the scope it was declared in, or
+// declares it in the current scope. The nodes of the env in front of the
+// declaration are copied, so closures created before keep the old value.
+func (c *Context) Assign(name string, value Value) {
+	if !c.assign(name, value) {
+		c.Declare(name, value)
+	}
 }
 
-func (c *Context) EndScope() {
-	for i := len(c.shadowed) - 1; i >= c.scope; i-- {
-		prevVar := c.shadowed[i]
+// assign sets a declared variable. It returns false if name is not
+// declared.
+func (c *Context) assign(name string, value Value) bool {
+	var path []*env
+	e := c.env
+	for ; e != nil; e = e.next {
+		if e.vars != nil {
+			if _, ok := e.vars[name]; ok {
+				break
+			}
+		} else if e.name == name {
+			break
+		}
+		path = append(path, e)
+	}
+	if e == nil {
+		return false
+	}
 
-		if prevVar.value == nil {
-			delete(c.vars, prevVar.name)
-		} else {
-			c.vars[prevVar.name] = varValue{prevVar.value, prevVar.scope}
+	replaced := &env{name: name, value: value, next: e.next}
+	if e.vars != nil {
+		// shadow the var instead of copying the map
+		replaced.next = e
+	}
+	c.relink(e, replaced)
+	for i := len(path) - 1; i >= 0; i-- {
+		copied := *path[i]
+		copied.next = replaced
+		c.relink(path[i], &copied)
+		replaced = &copied
+	}
+	c.env = replaced
+	return true
+}
+
+// relink replaces old by new in the saved scopes of c.
+func (c *Context) relink(old, new *env) {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if c.scopes[i] == old {
+			c.scopes[i] = new
 		}
 	}
+}
 
-	c.shadowed = c.shadowed[:c.scope]
-	c.scope = c.prevScopes[len(c.prevScopes)-1]
-	c.prevScopes = c.prevScopes[:len(c.prevScopes)-1]
+func (c *Context) BeginScope() {
+	c.scopes = append(c.scopes, c.env)
+}
+
+func (c *Context) EndScope() {
+	c.env = c.scopes[len(c.scopes)-1]
+	c.scopes = c.scopes[:len(c.scopes)-1]
 }
 
 type ValueWriter interface {
@@ -144,10 +479,23 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 		value Value
 	)
 
+	defer func() {
+		if err != nil && !isSignal(err) && ip > 0 {
+			err = errorAt(err, code[ip-1].pos)
+		}
+	}()
+
 	for ip < len(code) {
 		instr := code[ip]
 		ip += 1
 
+		if c.exec != nil {
+			err = c.exec.step()
+			if err != nil {
+				return
+			}
+		}
+
 		switch instr.op {
 		case emit:
 			err = wr.WriteValue(StringValue(instr.sarg))
@@ -183,14 +531,26 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 				return err
 			}
 			stack.Push(retBuilder.Value())
+		case emitCallMethod:
+			err = evalCallMethod(c, &stack, instr, wr)
+			if err != nil {
+				return err
+			}
+		case pushCallMethod:
+			retBuilder := returnValueBuilder{}
+			err = evalCallMethod(c, &stack, instr, &retBuilder)
+			if err != nil {
+				return err
+			}
+			stack.Push(retBuilder.Value())
 		case emitCallDyn:
-			err = evalCallDyn(&stack, instr, wr)
+			err = evalCallDyn(c, &stack, instr, wr)
 			if err != nil {
 				return err
 			}
 		case pushCallDyn:
 			retBuilder := returnValueBuilder{}
-			err = evalCallDyn(&stack, instr, &retBuilder)
+			err = evalCallDyn(c, &stack, instr, &retBuilder)
 			if err != nil {
 				return err
 			}
@@ -222,6 +582,53 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 				return err
 			}
 			stack.Push(value)
+		case emitNeg:
+			value, err = negateValue(stack.Pop())
+			if err != nil {
+				return err
+			}
+			err = wr.WriteValue(value)
+			if err != nil {
+				return err
+			}
+		case pushNeg:
+			value, err = negateValue(stack.Pop())
+			if err != nil {
+				return err
+			}
+			stack.Push(value)
+		case emitIndex:
+			value, err = evalIndex(c, &stack)
+			if err != nil {
+				return err
+			}
+			err = wr.WriteValue(value)
+			if err != nil {
+				return err
+			}
+		case pushIndex:
+			value, err = evalIndex(c, &stack)
+			if err != nil {
+				return err
+			}
+			stack.Push(value)
+		case emitSlice:
+			args := stack.PopN(3)
+			value, err = sliceValue(c.exec, args[0], args[1], args[2])
+			if err != nil {
+				return err
+			}
+			err = wr.WriteValue(value)
+			if err != nil {
+				return err
+			}
+		case pushSlice:
+			args := stack.PopN(3)
+			value, err = sliceValue(c.exec, args[0], args[1], args[2])
+			if err != nil {
+				return err
+			}
+			stack.Push(value)
 		case emitSubprog:
 			value, err = evalSubprog(c, instr)
 			if err != nil {
@@ -238,7 +645,7 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 			}
 			stack.Push(value)
 		case emitCompare:
-			value, err = evalCompare(&stack, instr)
+			value, err = evalCompare(c, &stack, instr)
 			if err != nil {
 				return err
 			}
@@ -247,7 +654,7 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 				return err
 			}
 		case pushCompare:
-			value, err = evalCompare(&stack, instr)
+			value, err = evalCompare(c, &stack, instr)
 			if err != nil {
 				return err
 			}
@@ -262,6 +669,14 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 			if !stack.Peek().Bool() {
 				ip += instr.iarg
 			}
+		case jumpNil:
+			if stack.Peek().Kind() == KindNil {
+				ip += instr.iarg
+			}
+		case jumpNotNil:
+			if stack.Peek().Kind() != KindNil {
+				ip += instr.iarg
+			}
 		case emitPop:
 			err = wr.WriteValue(stack.Pop())
 			if err != nil {
@@ -270,8 +685,9 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 		case discardPop:
 			stack.Pop()
 		case storePop:
-			value := stack.Pop()
-			c.Assign(instr.sarg, value)
+			if !c.assign(instr.sarg, stack.Pop()) {
+				return &ErrName{instr.sarg}
+			}
 		case declarePop:
 			value := stack.Pop()
 			c.Declare(instr.sarg, value)
@@ -287,7 +703,7 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 				return err
 			}
 		case emitBinaryOP:
-			value, err = evalBinaryOP(&stack, instr)
+			value, err = evalBinaryOP(c, &stack, instr)
 			if err != nil {
 				return err
 			}
@@ -296,7 +712,7 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 				return err
 			}
 		case pushBinaryOP:
-			value, err = evalBinaryOP(&stack, instr)
+			value, err = evalBinaryOP(c, &stack, instr)
 			if err != nil {
 				return err
 			}
@@ -319,15 +735,20 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 			stack.Push(Nil)
 		case pushIter:
 			value := stack.Pop()
-			iter, err := value.Iter()
+			var iter ValueIter
+			if instr.iarg != 0 && value.Kind() == KindObject {
+				iter, err = iterItems(value)
+			} else {
+				iter, err = iterContext(c.goContext(), value)
+			}
 			if err != nil {
 				return err
 			}
-			c.iters = append(c.iters, iter)
+			c.iters = append(c.iters, newLoopState(iter, value))
 		case iterNextOrJump:
-			value, err = c.iters[len(c.iters)-1].Next()
+			value, err = c.iters[len(c.iters)-1].next()
 			if err == nil {
-				c.Assign(instr.sarg, value)
+				stack.Push(value)
 			} else {
 				if err == ErrIterExhausted {
 					ip += instr.iarg
@@ -335,8 +756,61 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 					return
 				}
 			}
+		case unpack:
+			var values []Value
+			values, err = unpackValue(stack.Pop(), instr.iarg)
+			if err != nil {
+				return err
+			}
+			for _, v := range values {
+				stack.Push(v)
+			}
+		case loopGuard:
+			err = c.loopGuard(instr.iarg)
+			if err != nil {
+				return err
+			}
 		case discardIter:
+			c.iters[len(c.iters)-1] = nil
 			c.iters = c.iters[:len(c.iters)-1]
+		case pushLoop:
+			l := &loopObject{state: c.iters[len(c.iters)-1], parent: Nil}
+			l.index = l.state.index
+			if parent, ok := stack.Pop().(objectMapper); ok {
+				if _, ok := parent.o.(*loopObject); ok {
+					l.parent = parent
+				}
+			}
+			stack.Push(objectMapper{l})
+		case emitExtends:
+			err = evalExtends(c, instr, wr)
+			if err != nil {
+				return err
+			}
+		case pushSuper:
+			if instr.iarg < 0 {
+				return fmt.Errorf("block '%s': %w", instr.sarg, ErrSuperNotFound)
+			}
+			value, err = evalSubprog(c, instr)
+			if err != nil {
+				return err
+			}
+			stack.Push(value)
+		case pushImport:
+			name := ""
+			name, err = stack.Pop().String()
+			if err != nil {
+				return err
+			}
+			value, err = evalImport(c, name)
+			if err != nil {
+				return err
+			}
+			stack.Push(value)
+		case jumpIterNotEmpty:
+			if c.iters[len(c.iters)-1].index >= 0 {
+				ip += instr.iarg
+			}
 		case beginScope:
 			c.BeginScope()
 			openScopes++
@@ -417,8 +891,56 @@ func EvalRaw(c *Context, code []Instr, wr ValueWriter) (err error) {
 				obj.SetKey(keyStr, value)
 				stack.Push(objectMapper{obj})
 			}
+		case emitLocal:
+			value, err = c.lookupLocal(instr)
+			if err != nil {
+				return
+			}
+			err = wr.WriteValue(value)
+			if err != nil {
+				return err
+			}
+		case pushLocal:
+			value, err = c.lookupLocal(instr)
+			if err != nil {
+				return
+			}
+			stack.Push(value)
+		case declareLocal:
+			c.setLocal(instr.iarg, stack.Pop())
+		case clearLocal:
+			c.setLocal(instr.iarg, nil)
+		case exportLocal:
+			if value := c.local(instr.iarg); value != nil {
+				c.redeclare(instr.sarg, value)
+			}
+		case pushList:
+			err = c.exec.checkListSize(instr.iarg)
+			if err != nil {
+				return err
+			}
+			items := stack.PopN(instr.iarg)
+			stack.Push(ListValue(append([]Value(nil), items...)))
 		case pushObject:
 			stack.Push(ObjectValue{})
+		case pushNamedArgs:
+			stack.Push(namedArgs{stack.Pop().(ObjectValue)})
+		case returnPop:
+			return &returnSignal{stack.Pop()}
+		case emitTry:
+			value, err = evalTry(c, instr, wr)
+			if err != nil {
+				return err
+			}
+			stack.Push(value)
+		case signalLoop:
+			return &loopSignal{instr.iarg}
+		case pushLoopSignal:
+			ok := c.loopSignal != nil && c.loopSignal.kind == instr.iarg
+			if ok {
+				c.loopSignal = nil
+			}
+			stack.Push(BoolValue(ok))
 		case extendObject:
 			obj, err := stack.Pop().Object()
 			if err != nil {
@@ -452,19 +974,164 @@ func evalCall(c *Context, stack *valueStack, instr Instr, wr ValueWriter) (err e
 	if err != nil {
 		return
 	}
-	return value.Call(Args{args}, wr)
+	return value.Call(newArgs(args, c.exec), wr)
+}
+
+// evalCallMethod calls the function the first argument has as key, like
+// namespaces of imported templates have. Otherwise it calls the variable
+// with all arguments, like evalCall.
+func evalCallMethod(c *Context, stack *valueStack, instr Instr, wr ValueWriter) (err error) {
+	args := stack.PopN(instr.iarg)
+
+	if args[0].Kind() == KindObject {
+		obj, err := args[0].Object()
+		if err != nil {
+			return err
+		}
+		if fn, ok := obj.Key(instr.sarg); ok && fn.Kind() == KindFunction {
+			return fn.Call(newArgs(args[1:], c.exec), wr)
+		}
+	}
+
+	value, err := c.Lookup(instr.sarg)
+	if err != nil {
+		return
+	}
+	return value.Call(newArgs(args, c.exec), wr)
 }
 
-func evalCallDyn(stack *valueStack, instr Instr, wr ValueWriter) (err error) {
+func evalCallDyn(c *Context, stack *valueStack, instr Instr, wr ValueWriter) (err error) {
 	allArgs := stack.PopN(instr.iarg + 1)
-	return allArgs[0].Call(Args{allArgs[1:]}, wr)
+	return allArgs[0].Call(newArgs(allArgs[1:], c.exec), wr)
 }
 
 func evalCallSubprogNA(c *Context, instr Instr, wr ValueWriter) error {
 	c.BeginScope()
 	defer c.EndScope()
 
-	return EvalRaw(c, c.subprogs[instr.iarg].Code, wr)
+	subprog := &c.subprogs[instr.iarg]
+	if !subprog.Inline {
+		saved := c.pushFrame(subprog.Slots, c.captureLocals(subprog.Captures))
+		defer c.popFrame(saved)
+	}
+	return EvalRaw(c, subprog.Code, wr)
+}
+
+// tryBuffer holds the output of the body of a try until it succeeded.
+// Values are converted to strings when they are written, so errors of
+// lazy values are caught by the try. Strings written with an output filter
+// pushed in the body are filtered when they are written, the others when
+// they are flushed.
+type tryBuffer struct {
+	c       *Context
+	filters int // output filters of the enclosing code
+	values  []string
+	raw     []bool
+	size    int // bytes charged to the output limit
+}
+
+func (b *tryBuffer) WriteValue(v Value) error {
+	str, err := v.String()
+	if err != nil {
+		return err
+	}
+	raw := len(b.c.outputFilters) > b.filters
+	if raw {
+		if f := b.c.outputFilters[len(b.c.outputFilters)-1]; f != nil {
+			str, err = f.Filter(str)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if b.c.exec != nil {
+		err = b.c.exec.write(len(str))
+		if err != nil {
+			return err
+		}
+		b.size += len(str)
+	}
+	b.values = append(b.values, str)
+	b.raw = append(b.raw, raw)
+	return nil
+}
+
+// release gives back the bytes charged for the buffered output. Flushed
+// output is charged again by the writer it is flushed to.
+func (b *tryBuffer) release() {
+	if b.c.exec != nil {
+		b.c.exec.output -= b.size
+	}
+	b.size = 0
+}
+
+func (b *tryBuffer) flush(wr ValueWriter) error {
+	for i, str := range b.values {
+		if b.raw[i] {
+			// no output filter for values filtered already
+			b.c.outputFilters = append(b.c.outputFilters, nil)
+		}
+		err := wr.WriteValue(StringValue(str))
+		if b.raw[i] {
+			b.c.outputFilters = b.c.outputFilters[:len(b.c.outputFilters)-1]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evalTry evaluates the body of a try. It returns Nil if the body
+// succeeded, or the object of the error to be handled by the catch branch.
+func evalTry(c *Context, instr Instr, wr ValueWriter) (Value, error) {
+	iters := len(c.iters)
+	b := tryBuffer{c: c, filters: len(c.outputFilters)}
+	err := evalCallSubprogNA(c, instr, &b)
+	b.release()
+	if err == nil || isSignal(err) {
+		// a return, break or continue leaves the try, but keeps its output
+		flushErr := b.flush(wr)
+		if flushErr != nil {
+			return nil, flushErr
+		}
+		if sig, ok := err.(*loopSignal); ok {
+			// loops inside the body are left as well
+			clear(c.iters[iters:])
+			c.iters = c.iters[:iters]
+			c.loopSignal = sig
+			return Nil, nil
+		}
+		return Nil, err
+	}
+	if !catchable(err) {
+		return nil, err
+	}
+
+	// loops the error left are still open
+	clear(c.iters[iters:])
+	c.iters = c.iters[:iters]
+	return errorObject(err, c.subprogs[instr.iarg].Template), nil
+}
+
+// loopSignal unwinds the body of a try for a break or continue of a loop
+// around the try. The try continues it with pushLoopSignal.
+type loopSignal struct {
+	kind int
+}
+
+func (s *loopSignal) Error() string {
+	return "break or continue outside of a loop"
+}
+
+// isSignal reports whether err unwinds the evaluation for a statement
+// instead of reporting a failure.
+func isSignal(err error) bool {
+	switch err.(type) {
+	case *returnSignal, *loopSignal:
+		return true
+	}
+	return false
 }
 
 func evalAttr(c *Context, stack *valueStack, instr Instr) (value Value, err error) {
@@ -475,7 +1142,8 @@ func evalAttr(c *Context, stack *valueStack, instr Instr) (value Value, err erro
 	}
 	value, ok := obj.Key(instr.sarg)
 	if !ok {
-		if c.NameError != nil {
+		// iarg is set for optional accesses (a?.name)
+		if c.NameError != nil && instr.iarg == 0 {
 			value, err = c.NameError(instr.sarg)
 		} else {
 			value = Nil
@@ -484,25 +1152,60 @@ func evalAttr(c *Context, stack *valueStack, instr Instr) (value Value, err erro
 	return
 }
 
+func evalIndex(c *Context, stack *valueStack) (value Value, err error) {
+	args := stack.PopN(2)
+	value, ok, err := indexValue(args[0], args[1])
+	if err == nil && !ok {
+		if c.NameError != nil {
+			key, _ := args[1].String()
+			value, err = c.NameError(key)
+		} else {
+			value = Nil
+		}
+	}
+	return
+}
+
 func evalSubprog(c *Context, instr Instr) (value Value, err error) {
-	subprog := c.subprogs[instr.iarg]
-	ctx := c.Clone()
-	value = &subprogValue{subprog.Code, subprog.Args, ctx.Clone()}
+	subprog := &c.subprogs[instr.iarg]
+	value = &subprogValue{
+		subprog:  subprog,
+		ctx:      c.Clone(),
+		captures: c.captureLocals(subprog.Captures),
+	}
 	return
 }
 
-func evalCompare(stack *valueStack, instr Instr) (value Value, err error) {
+func evalCompare(c *Context, stack *valueStack, instr Instr) (value Value, err error) {
 	args := stack.PopN(2)
 
-	ok, err := compareValues(args[0], args[1], instr.iarg)
+	var ok bool
+	switch instr.iarg {
+	case IN:
+		ok, err = containsValue(c.goContext(), args[1], args[0])
+	case NOTIN:
+		ok, err = containsValue(c.goContext(), args[1], args[0])
+		ok = !ok
+	default:
+		ok, err = compareValues(args[0], args[1], instr.iarg)
+	}
 	value = BoolValue(ok)
 	return
 }
 
-func evalBinaryOP(stack *valueStack, instr Instr) (value Value, err error) {
+func evalBinaryOP(c *Context, stack *valueStack, instr Instr) (value Value, err error) {
 	args := stack.PopN(2)
 
+	if instr.iarg == ADD {
+		err = c.exec.checkConcat(args[0], args[1])
+		if err != nil {
+			return
+		}
+	}
 	value, err = binaryOPValues(args[0], args[1], instr.iarg)
+	if err == nil && c.exec != nil {
+		err = c.exec.checkValue(value)
+	}
 	return
 }
 
@@ -515,13 +1218,101 @@ func evalNumber(instr Instr) (value Value) {
 func evalTemplate(c *Context, name string, wr ValueWriter) (err error) {
 	tpl, ok := c.templates[name]
 	if ok {
+		saved := c.pushFrame(tpl.Slots, nil)
+		defer c.popFrame(saved)
+
+		if c.exec != nil {
+			err = c.exec.enter()
+			if err != nil {
+				return
+			}
+			defer c.exec.leave()
+		}
+
 		err = EvalRaw(c, tpl.Code, wr)
+		if err != nil {
+			err = closeFrame(err, name, "")
+		}
 	} else if c.TemplateNotFound != nil {
 		err = c.TemplateNotFound(name)
 	}
 	return
 }
 
+// evalExtends renders the linked parent template of instr.
+func evalExtends(c *Context, instr Instr, wr ValueWriter) (err error) {
+	if instr.iarg < 0 {
+		return fmt.Errorf("'%s': %w", instr.sarg, ErrParentNotFound)
+	}
+	subprog := &c.subprogs[instr.iarg]
+	saved := c.pushFrame(subprog.Slots, nil)
+	defer c.popFrame(saved)
+
+	err = EvalRaw(c, subprog.Code, wr)
+	if err != nil {
+		err = closeFrame(err, subprog.Template, "")
+	}
+	return
+}
+
+var ErrImportCycle = errors.New("template imports itself")
+
+// importState caches the templates imported during a render.
+type importState struct {
+	env    *env             // the variables visible to imported templates
+	values map[string]Value // nil while the template is imported
+}
+
+type discardWriter struct{}
+
+func (discardWriter) WriteValue(v Value) error {
+	return nil
+}
+
+// evalImport returns an object of the variables declared at the top level
+// of the template name. The template is rendered once per render, without
+// output and without seeing the variables of the importing template.
+func evalImport(c *Context, name string) (Value, error) {
+	if c.imports == nil {
+		c.imports = &importState{}
+	}
+	st := c.imports
+	if value, ok := st.values[name]; ok {
+		if value == nil {
+			return nil, fmt.Errorf("'%s': %w", name, ErrImportCycle)
+		}
+		return value, nil
+	}
+	if _, ok := c.templates[name]; !ok {
+		if c.TemplateNotFound != nil {
+			return nil, c.TemplateNotFound(name)
+		}
+		return ObjectValue{}, nil
+	}
+	if st.values == nil {
+		st.values = map[string]Value{}
+	}
+	st.values[name] = nil
+
+	prevEnv := c.env
+	c.env = st.env
+	err := evalTemplate(c, name, discardWriter{})
+	obj := ObjectValue{}
+	for e := c.env; e != st.env && e != nil; e = e.next {
+		if _, ok := obj[e.name]; !ok && e.vars == nil {
+			obj[e.name] = e.value
+		}
+	}
+	c.env = prevEnv
+	if err != nil {
+		delete(st.values, name)
+		return nil, err
+	}
+
+	st.values[name] = obj
+	return obj, nil
+}
+
 type stringBuilder struct {
 	c *Context
 	b strings.Builder
@@ -558,10 +1349,11 @@ func (c *Context) EvalTemplateRaw(name string, vars Vars, wr ValueWriter) error
 	c.BeginScope()
 	defer c.EndScope()
 
-	for name, value := range vars {
-		c.Declare(name, value)
-	}
+	prevImports := c.imports
+	c.imports = &importState{env: c.env}
+	defer func() { c.imports = prevImports }()
 
+	c.declareVars(vars)
 	return evalTemplate(c, name, wr)
 }
 
@@ -589,6 +1381,12 @@ func (w *outputWriter) WriteValue(v Value) error {
 			}
 		}
 	}
+	if w.c.exec != nil {
+		err = w.c.exec.write(len(str))
+		if err != nil {
+			return err
+		}
+	}
 	n, err := w.w.Write([]byte(str))
 	if err == nil && n < len(str) {
 		err = io.ErrShortWrite
@@ -603,8 +1401,23 @@ func EvalWriter(c *Context, code []Instr, wr io.Writer) error {
 }
 
 func (c *Context) EvalTemplateWriter(name string, vars Vars, wr io.Writer) error {
+	return c.EvalTemplateWriterContext(context.Background(), name, vars, wr)
+}
+
+// EvalTemplateWriterContext is like EvalTemplateWriter, but stops the
+// evaluation with the error of ctx once ctx is done.
+func (c *Context) EvalTemplateWriterContext(ctx context.Context, name string, vars Vars, wr io.Writer) error {
+	prevExec := c.exec
+	c.exec = &execState{ctx: ctx, limits: c.Limits}
+	defer func() { c.exec = prevExec }()
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
 	w := outputWriter{c: c, w: wr}
-	err := c.EvalTemplateRaw(name, vars, &w)
+	err = c.EvalTemplateRaw(name, vars, &w)
 	return err
 }
 
@@ -649,8 +1462,12 @@ func (w *returnValueBuilder) Value() Value {
 }
 
 func Call(v Value, args []Value) (Value, error) {
+	return callExec(nil, v, args)
+}
+
+func callExec(exec *execState, v Value, args []Value) (Value, error) {
 	wr := returnValueBuilder{}
-	err := v.Call(Args{args}, &wr)
+	err := v.Call(Args{args: args, exec: exec}, &wr)
 	return wr.Value(), err
 }
 
@@ -711,3 +1528,128 @@ func (l *listIter) Next() (Value, error) {
 	}
 	return nil, ErrIterExhausted
 }
+
+// itemsIter iterates the keys of an object in sorted order, yielding
+// [key, value] pairs.
+type itemsIter struct {
+	obj  Object
+	keys []string
+}
+
+var _ ValueIter = &itemsIter{}
+
+func (it *itemsIter) Next() (Value, error) {
+	if len(it.keys) == 0 {
+		return nil, ErrIterExhausted
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	value, ok := it.obj.Key(key)
+	if !ok {
+		value = Nil
+	}
+	return ListValue{StringValue(key), value}, nil
+}
+
+func iterItems(v Value) (ValueIter, error) {
+	obj, err := v.Object()
+	if err != nil {
+		return nil, err
+	}
+	keys := obj.Keys()
+	sort.Strings(keys)
+	return &itemsIter{obj, keys}, nil
+}
+
+// loopState is the iterator of a for loop.
+type loopState struct {
+	iter     ValueIter
+	index    int
+	length   int // -1 if unknown
+	peeked   bool
+	peekItem Value
+	peekErr  error
+}
+
+func newLoopState(iter ValueIter, v Value) *loopState {
+	l := &loopState{iter: iter, index: -1, length: -1}
+	switch v := v.(type) {
+	case ListValue:
+		l.length = len(v)
+	case ObjectValue:
+		l.length = len(v)
+	case reflectList:
+		l.length = v.rv.Len()
+	case *reflectObjectValue:
+		// iterating a reflected map or struct iterates its keys
+		l.length = len(v.obj.Keys())
+	}
+	return l
+}
+
+func (l *loopState) next() (v Value, err error) {
+	if l.peeked {
+		v, err = l.peekItem, l.peekErr
+		l.peeked, l.peekItem, l.peekErr = false, nil, nil
+	} else {
+		v, err = l.iter.Next()
+	}
+	if err == nil {
+		l.index++
+	}
+	return
+}
+
+// last reports whether the item at index is the last one. If the length
+// is not known, it reads the next item ahead.
+func (l *loopState) last(index int) bool {
+	if l.length >= 0 {
+		return index == l.length-1
+	}
+	if index < l.index {
+		// the loop already went on to the next item
+		return false
+	}
+	if !l.peeked {
+		l.peekItem, l.peekErr = l.iter.Next()
+		l.peeked = true
+	}
+	return l.peekErr == ErrIterExhausted
+}
+
+// loopObject is the loop object of a single iteration. Closures created in
+// the body keep the state of the iteration they were created in.
+type loopObject struct {
+	state  *loopState
+	index  int
+	parent Value
+}
+
+var _ Object = &loopObject{}
+
+func (l *loopObject) Key(name string) (Value, bool) {
+	switch name {
+	case "index":
+		return NumberValue(l.index), true
+	case "index1":
+		return NumberValue(l.index + 1), true
+	case "first":
+		return BoolValue(l.index == 0), true
+	case "last":
+		return BoolValue(l.state.last(l.index)), true
+	case "length":
+		if l.state.length < 0 {
+			return Nil, true
+		}
+		return NumberValue(l.state.length), true
+	case "parent":
+		return l.parent, true
+	}
+	return nil, false
+}
+
+func (l *loopObject) SetKey(name string, value Value) {}
+
+func (l *loopObject) Keys() []string {
+	return []string{"first", "index", "index1", "last", "length", "parent"}
+}
@@ -1,11 +1,14 @@
 package tplexpr
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestEval(t *testing.T) {
@@ -53,6 +56,43 @@ func TestEval(t *testing.T) {
 		{`${for x in list("1", "2", "3") do "$x" endfor}`, "123", nil},
 		{`${block(tpl, name)}Hello $name${endblock}`, "", nil},
 		{`${block(tpl, name)}Hello $name${endblock}${tpl("World")}`, "Hello World", nil},
+		{`${block(card, title, body = "-")}[$title|$body]${endblock card("a") card("a", "b")}`, "[a|-][a|b]", nil},
+		{`${block(card, title, body = "-")}[$title|$body]${endblock card(body => "b", title => "t")}`, "[t|b]", nil},
+		{`${block(card, title, body = "-")}[$title|$body]${endblock card("t", body => nil)}`, "[t|]", nil},
+		{`${block(f, a, b = a + 1)}$a$b${endblock f(1) f(1, 5)}`, "1215", nil},
+		{`${block(f, a, ...rest)}$a:${rest |> join("+")}${endblock f(1) f(1, 2, 3)}`, "1:1:2+3", nil},
+		{`${block(f, ...rest, **kwargs)}${rest kwargs.x kwargs.y}${endblock f(1, x => 2, y => 3)}`, "123", nil},
+		{`${declare(f, (a, b = 2) => "${a + b}") f(1) f(1, b => 3)}`, "34", nil},
+		{`${greet("a", greeting => "Hi") greet("b")}`, "Hi aHello b", map[string]Value{"greet": NamedFuncValue(func(args Args) (Value, error) {
+			greeting, ok := args.Named("greeting")
+			if !ok {
+				greeting = StringValue("Hello")
+			}
+			return ListValue{greeting, args.Get(0)}, nil
+		})}},
+		{`${declare(f, (a) => "$a") [1] |> f()}`, "1", nil},
+		{`${block(f)}  ${return [1, 2]}${endblock declare(x, f()) x[1]}`, "2", nil},
+		{`${block(find, xs, v)}${for x in xs do if x == v then return "found" endif endfor "missing"}${endblock find([1, 2], 2) find([1], 3)}`, "foundmissing", nil},
+		{`${declare(f, (a) => do declare(b, a * 2) return {a: a, b: b} end) f(2).b}`, "4", nil},
+		{`${declare(f, (xs) => do for x in xs do if x > 1 then return x endif endfor return nil end) f([1, 2, 3])}`, "2", nil},
+		{`${o.end} ${o?.end} ${{end: 1, return: 2}.end} ${declare(f, (r) => do r.end - r.start end) f({start: 1, end: 3})}`, "5 5 1 2", map[string]Value{"o": ObjectValue{"end": NumberValue(5)}}},
+		{`${block(g)}${for x in [1] do return x endfor}${endblock for y in [7, 8] do g y endfor}`, "1718", nil},
+		{`${try}a${error("x")}b${catch e}[${e.message}|${e.kind}]${endtry}`, "[x|error]", nil},
+		{`${try}ok${catch e}failed${endtry}`, "ok", nil},
+		{`${o.try} ${o.catch} ${{endtry: 3}.endtry}`, "1 2 3", map[string]Value{"o": ObjectValue{"try": NumberValue(1), "catch": NumberValue(2)}}},
+		{`${try}a${1 / 0}${endtry}b`, "b", nil},
+		{`${try 1 / 0 catch e e.kind endtry}`, "division", nil},
+		{`${try raise("gone", "missing") catch e e.kind endtry}`, "missing", nil},
+		{`${declare(x, try [1] catch e e.message endtry) x[0]}`, "1", nil},
+		{`${for x in [1, 2] do try for y in [1] do error("e") endfor catch e x endtry endfor}`, "12", nil},
+		{`${block(f)}${try return [1] catch e 2 endtry}${endblock declare(r, f()) r[0]}`, "1", nil},
+		{`${for x in [1, 2, 3] do try if x == 2 then continue endif x endtry endfor}`, "13", nil},
+		{`${for x in [1, 2, 3] do try x if x == 2 then break endif endtry "," endfor}`, "1,2", nil},
+		{`${for x in [1, 2, 3] do try try for y in [x] do if y == 2 then continue endif y endfor if x == 2 then break endif endtry endtry endfor}`, "1", nil},
+		{`${for x in [1, 2, 3] do try error("e") catch e if x == 2 then break endif x endtry endfor}`, "1", nil},
+		{`${declare(i, 0) while i < 5 do set i = i + 1 try if i == 2 then continue endif if i == 4 then break endif i endtry endwhile}`, "13", nil},
+		{`${for x in [1, 2] do try for y in [1, 2] do if y == 2 then break endif x endfor try continue endtry endtry "!" endfor}`, "12", nil},
+		{"${try}\n  ${error('x')}${catch e}${e.template}:${e.position}${endtry}", ":2:5", nil},
 		{`${if false then "A" elseif true then "B" else "C" endif}`, "B", nil},
 		{`${if true then "A" elseif true then "B" else "C" endif}`, "A", nil},
 		{`${if true then "A" elseif false then "B" else "C" endif}`, "A", nil},
@@ -64,8 +104,93 @@ func TestEval(t *testing.T) {
 		{`${range(2, 0, -1)}`, `2 1`, nil},
 		{`${declare(x, object(a => 1, b => 2))}${x.b}${x.a}`, "21", nil},
 		{`${declare(x, object(a => 1)) declare(y, object(x, b => 2))}${y.a y.b}`, "12", nil},
+		{`${msg.from} ${msg?.as} ${{from: 1, import: 2}.import}`, "a@b c 2", map[string]Value{"msg": ObjectValue{"from": StringValue("a@b"), "as": StringValue("c")}}},
+		{`${[1, "a", [2, 3]]}`, "1 a 2 3", nil},
+		{`${[]}${[x,]}`, "1", map[string]Value{"x": NumberValue(1)}},
+		{`${declare(o, {a: 1, "b-c": 2, [k]: 3,})}${o.a}${o.k}${o.x}`, "13", map[string]Value{"k": StringValue("x")}},
+		{`${{}.json()}`, "{}", nil},
+		{`${xs[0]}${xs[-1]}${xs[1:]}|${xs[:-1]}|${xs[5:]}|${xs[:]}`, "132 3|1 2||1 2 3", map[string]Value{"xs": ListValue{NumberValue(1), NumberValue(2), NumberValue(3)}}},
+		{`${s[0]}${s[-1]}${s[1:3]}${s[-2:10]}`, "äcbcbc", map[string]Value{"s": StringValue("äbc")}},
+		{`${o["b-c"]}${o[k]}${o.list[1]}${o["x"]}`, "12b", map[string]Value{"o": ObjectValue{"b-c": NumberValue(1), "a": NumberValue(2), "list": ListValue{StringValue("a"), StringValue("b")}}, "k": StringValue("a")}},
+		{`${r[1]}${r[-1:]}${m["k"]}`, "23v", map[string]Value{"r": Reflect([]int{1, 2, 3}), "m": Reflect(map[string]string{"k": "v"})}},
+		{`${declare(ys, xs[:1] + 4) xs ys}`, "1 2 31 4", map[string]Value{"xs": ListValue{NumberValue(1), NumberValue(2), NumberValue(3)}}},
+		{`${2 > 1} ${1 > 1} ${1 >= 1} ${0 >= 1} ${1 < 2} ${2 <= 1}`, "true false true false true false", nil},
+		{`${!true}${!x}${!!x}${!(1 > 2)}`, "falsefalsetruetrue", map[string]Value{"x": StringValue("x")}},
+		{`${-x} ${-1} ${- -1} ${3-1} ${3 - -1} ${1e-1 + 1}`, "-2 -1 1 2 4 1.1", map[string]Value{"x": NumberValue(2)}},
+		{`${7 % 3} ${-7 % 3} ${7 % -3} ${7.5 % 2}`, "1 2 -2 1.5", nil},
+		{`${7 // 2} ${-7 // 2} ${7 / 2}`, "3 -4 3.5", nil},
+		{`${2 ** 3 ** 2} ${-2 ** 2} ${2 ** -1} ${(-2) ** 2}`, "512 -4 0.5 4", nil},
+		{`${1 + 2 * 3 ** 2 % 5 - 4 // 3}`, "3", nil},
+		{`${n ?? 1} ${0 ?? 1} ${"" ?? 1} ${n ?? n ?? 2} ${n || 0 ?? 1}`, "1 0  2 0", map[string]Value{"n": Nil}},
+		{`${n?.a} ${n?.a.b.c} ${n?.a.join()} ${o?.a?.b} ${o?.x} ${o?.a.upper()}`, "   c  B", map[string]Value{"n": Nil, "o": ObjectValue{"a": ObjectValue{"b": StringValue("c")}}}},
+		{`${o?.a ?? "anonymous"} ${n?.a ?? "anonymous"}`, "0 anonymous", map[string]Value{"n": Nil, "o": ObjectValue{"a": NumberValue(0)}}},
+		{`${2 in [1, 2]} ${"2" in [1, 2]} ${3 not in [1, 2]} ${2 in range(3)} ${2 in r}`, "true false true true true", map[string]Value{"r": Reflect([]int{1, 2})}},
+		{`${"ell" in "hello"} ${"x" not in "hello"} ${1 in "a1"}`, "true true true", nil},
+		{`${"a" in o} ${"b" in o} ${"A" in m} ${"B" not in m}`, "true false true true", map[string]Value{"o": ObjectValue{"a": Nil}, "m": Reflect(map[string]int{"A": 1})}},
+		{`${o.not} ${o?.in} ${{not: 1, in: 2}.not} ${o.not not in [1]}`, "1 2 1 false", map[string]Value{"o": ObjectValue{"not": NumberValue(1), "in": NumberValue(2)}}},
+		{`${(x) => "x$x"} ${[1, 2].map((x, i, extra) => "$x$i$extra").join(",")}`, "x 10,21", nil},
+		{`${declare(not, 1) not + 1} ${not not in [1]}`, "2 false", nil},
+		{`${declare(set, 1) set set = set + 1}$set ${declare(assign, 1) assign(assign, 3)}$assign`, "2 3", nil},
+		{`${declare(f, (end) => do return end + 1 end) f(1)}`, "2", nil},
+		{`${try error("x") catch catch catch.message endtry}`, "x", nil},
+		{`${declare(endwhile, 0) while endwhile < 2 do set endwhile = endwhile + 1 endwhile}$endwhile`, "2", nil},
+		{`${if role in allowed then "yes" else "no" endif}`, "yes", map[string]Value{"role": StringValue("admin"), "allowed": ListValue{StringValue("admin")}}},
+		{`${"  hello world " |> trim |> upper |> truncate(8)}`, "HELLO...", nil},
+		{`${x |> truncate(20, "!")}|${x |> truncate(3, "")}|${x |> truncate(1)}`, "hello|hel|h", map[string]Value{"x": StringValue("hello")}},
+		{`${[3, 1, 2] |> sorted |> join(",")}`, "1,2,3", nil},
+		{`${"a" |> o.f()} ${"b" |> o.f("c")}`, "a b c", map[string]Value{"o": ObjectValue{"f": FuncValue(BuiltinList)}}},
+		{`${if x |> upper == "A" then "yes" endif} ${-n |> abs} ${1 + n |> abs} ${x |> upper in ["A"]}`, "yes -2 3 true", map[string]Value{"x": StringValue("a"), "n": NumberValue(-2)}},
+		{`${1 |> (x) => "<$x>"} ${2 |> o.f} ${3 |> o["f"]()} ${4 |> add(1)}`, "<1> 2 3 5", map[string]Value{"o": ObjectValue{"f": FuncValue(BuiltinList)}, "add": FuncValue(func(args Args) (Value, error) {
+			a, _ := args.Get(0).Number()
+			b, _ := args.Get(1).Number()
+			return NumberValue(a + b), nil
+		})}},
+		{`${n ?? "a" |> upper}`, "A", map[string]Value{"n": Nil}},
+		{`${declare(x, o.set) set x = x + o.assign x} ${{set: 1, assign: 2}.assign}`, "3 2", map[string]Value{"o": ObjectValue{"set": NumberValue(1), "assign": NumberValue(2)}}},
+		{`${declare(i, 0) while i < 3 do i set i = i + 1 endwhile}`, "012", nil},
+		{`${declare(i, 0) while true do set i = i + 1 if i % 2 then continue endif if i > 6 then break endif i endwhile}`, "246", nil},
+		{`${for x in range(3) do declare(y, x) while y > 0 do y set y = y - 1 endwhile endfor}`, "121", nil},
+		{`${declare(s, while false do endwhile) declare(i, 0) declare(t, while i < 2 do set i = i + 1 "x" endwhile) s t}`, "xx", nil},
 		{`${declare(x, list(1)) declare(y, x.append(2, 3)) y}`, "1 2 3", nil},
 		{`${declare(x, list(1)) declare(y, list(2, 3)) x.extend(y)}`, "1 2 3", nil},
+		{`${for x in range(10) do if x == 3 then break endif x endfor}`, "012", nil},
+		{`${for x in range(5) do if x == 2 then continue endif x endfor}`, "0134", nil},
+		{`${for x in range(3) do for y in range(3) do if y > x then break endif y endfor endfor}`, "001012", nil},
+		{`${for x in range(4) do discard if x == 2 then continue endif enddiscard x endfor}`, "013", nil},
+		{`${declare(s, for x in range(5) do if x == 3 then break endif x endfor) s}`, "012", nil},
+		{`${for x in range(5) do if x == 1 then declare(y, x) continue endif "$x$y" endfor}`, "0234", nil},
+		{`${declare(x, 1) if true then declare(y, 2) declare(f, () => "$x$y") declare(y, 3) f() y endif}`, "123", nil},
+		{`${if true then declare(a, "A") block(f) block(g) a endblock g() endblock f() endif}`, "A", nil},
+		{`${for i in range(3) do declare(s, "$s$i") s endfor s}`, "001012", nil},
+		{`${for i in range(2) do declare(n, 0) for j in range(3) do declare(n, n + 1) endfor n endfor}`, "00", nil},
+		{`${for i in range(3) do declare(f, (x) => "${x + i}") f(10) endfor}`, "101112", nil},
+		{`${for k, v in {b: 2, a: 1, c: 3} do "$k=$v;" endfor}`, "a=1;b=2;c=3;", nil},
+		{`${for k in {b: 2, a: 1} do k endfor}`, "ab", nil},
+		{`${for i, x in enumerate(list("a", "b")) do "$i$x" endfor}`, "0a1b", nil},
+		{`${for i, x in enumerate(list("x", "y"), 1) do "$i$x" endfor}`, "1x2y", nil},
+		{`${for a, b, c in [[1, 2, 3], [4, 5, 6]] do a + b * c endfor}`, "734", nil},
+		{`${for a, b in [[1, 2]] do declare(f, () => "${a + b}") declare(a, 0) f() endfor}`, "3", nil},
+		{`${for a, b in [[1, 2]] do declare(a, 5) a + b endfor}`, "7", nil},
+		{`${for i, _ in enumerate(range(3)) do if i == 1 then continue endif i endfor}`, "02", nil},
+		{`${for x in list("a", "b", "c") do x if !loop.last then ", " endif endfor}`, "a, b, c", nil},
+		{`${for x in range(3) do x if !loop.last then ", " endif endfor}`, "0, 1, 2", nil},
+		{`${for x in range(4) do if loop.index % 2 then "odd" else "even" endif loop.index1 " " endfor}`, "even1 odd2 even3 odd4 ", nil},
+		{`${for x in [1, 2] do loop.first loop.length endfor}`, "true2false2", nil},
+		{`${for x in range(2) do loop.length ?? "?" endfor}`, "??", nil},
+		{`${for x in s do loop.length endfor} ${for x in a do loop.length - loop.index endfor} ${for k, v in m do loop.length endfor}`, "22 21 22", map[string]Value{"s": Reflect([]string{"a", "b"}), "a": Reflect([2]int{1, 2}), "m": Reflect(map[string]int{"a": 1, "b": 2})}},
+		{`${for x in range(2) do for y in range(2) do "${loop.parent.index}${loop.index} " endfor endfor}`, "00 01 10 11 ", nil},
+		{`${for x in range(2) do declare(f, () => "${for y in [0] do loop.parent.index endfor}") f() endfor}`, "01", nil},
+		{`${declare(fs, []) for x in range(3) do set fs = append(fs, () => "${loop.index}${loop.first}${loop.last}") endfor fs.map((f) => "${f()}").join(" ")}`, "0truefalse 1falsefalse 2falsetrue", nil},
+		{`${for y in [1] do for x in [] do x else loop.index endfor endfor}`, "0", nil},
+		{`${for x in [] do x else "empty" endfor}`, "empty", nil},
+		{`${for x in [1] do x else "empty" endfor}`, "1", nil},
+		{`${for x in [1, 2] do if x == 1 then break endif else "empty" endfor}`, "", nil},
+		{`${for x in range(3) do for y in [] do else if x == 1 then continue endif "e" endfor x endfor}`, "e0e2", nil},
+		{`${for x in range(3) do for y in [] do else if x == 1 then break endif "e" endfor x endfor}`, "e0", nil},
+		{`${declare(s, for x in [] do x else "none" endfor) s}`, "none", nil},
+		{`${declare(loop, 1) for x in [1] do loop.index endfor loop}`, "01", nil},
+		{`${declare(o, {f: (x) => "<$x>"}) o.f(1)}`, "<1>", nil},
+		{`${declare(o, {kind: 1}) o.kind()}`, "object", nil},
 	}
 
 	for i := range testCases {
@@ -119,6 +244,24 @@ func TestEvalTemplate(t *testing.T) {
 		Eval(t, "main",
 			`Hello World Hello Sina`,
 		)
+
+	evalTest("include locals").
+		Template("row", `<$item$x>`).
+		Template("main", `${for item in items do include("row") endfor block(b, x) include("row") endblock b(1)}`).
+		Var("items", L{S("a"), S("b")}).
+		Eval(t, "main", `<a><b><1>`)
+
+	evalTest("extends").
+		Template("child", `${extends "base" declare(x, 1) block(b, n)}<${super(n)}>${endblock} ignored`).
+		Template("base", `${block(a)}a${endblock block(b, n)}b$n${endblock}[${a() b(x)}]`).
+		Eval(t, "child", `[a<b1>]`)
+
+	chain := evalTest("extends chain").
+		Template("base", `${block(a)}a${endblock block(b)}b${endblock a() b()}`).
+		Template("mid", `${extends "base" block(a)}(${super()})${endblock}`).
+		Template("leaf", `${extends "mid" block(a)}[${super()}]${endblock block(b)}${declare(f, () => "${super()}") f()}!${endblock}`)
+	chain.Eval(t, "leaf", `[(a)]b!`)
+	chain.Eval(t, "mid", `(a)b`)
 }
 
 type evalTestImpl struct {
@@ -188,22 +331,7 @@ func (r *testReflect) GreetS() string {
 	return fmt.Sprintf("Hello %s", r.S)
 }
 
-func TestEvalFile(t *testing.T) {
-	fsys := os.DirFS("testdata")
-	glob := "*.test.txt"
-	matches, err := fs.Glob(fsys, glob)
-	if err != nil {
-		t.Error(err)
-		return
-	}
-	store, err := BuildStore().
-		AddFS(fsys, glob, "*.template.txt").
-		Build()
-	if err != nil {
-		t.Error(err)
-		return
-	}
-
+func testFileVars() *VarsBuilder {
 	r := Reflect(&testReflect{
 		Numbers: []int{1, 2, 3, 4},
 		Floats:  []float64{0.25, 0.5, 0.75, 1},
@@ -221,11 +349,30 @@ func TestEvalFile(t *testing.T) {
 		},
 	})
 
-	vars := BuildVars().
+	return BuildVars().
 		Set("lst", L{N(1), N(2), S("one"), S("two")}).
 		SetString("s", "Hello World").
 		SetString("q", "Q").
 		Set("r", r)
+}
+
+func TestEvalFile(t *testing.T) {
+	fsys := os.DirFS("testdata")
+	glob := "*.test.txt"
+	matches, err := fs.Glob(fsys, glob)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	store, err := BuildStore().
+		AddFS(fsys, glob, "*.template.txt").
+		Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	vars := testFileVars()
 
 	for _, fileName := range matches {
 		t.Logf("Test with file %s", fileName)
@@ -250,3 +397,598 @@ func TestEvalFile(t *testing.T) {
 		}
 	}
 }
+
+func TestLoopControlOutsideLoop(t *testing.T) {
+	inputs := []string{
+		`${break}`,
+		`${continue}`,
+		`${for x in range(3) do block(b) break endblock endfor}`,
+		`${for x in range(3) do declare(y, if x then break endif) endfor}`,
+		`${try break endtry}`,
+		`${for x in range(3) do declare(y, try continue endtry) endfor}`,
+	}
+
+	for _, input := range inputs {
+		t.Logf("Compile %s", input)
+
+		cc := NewCompileContext()
+		err := cc.ParseTemplate("loop", []byte(input))
+		if !errors.Is(err, ErrLoopControl) {
+			t.Errorf("expected ErrLoopControl, got %v", err)
+		}
+	}
+}
+
+func TestReturnOutsideSubprog(t *testing.T) {
+	inputs := []string{
+		`${return 1}`,
+		`${for x in range(3) do return x endfor}`,
+		`${declare(x, if true then return 1 endif)}`,
+	}
+
+	for _, input := range inputs {
+		t.Logf("Compile %s", input)
+
+		cc := NewCompileContext()
+		err := cc.ParseTemplate("return", []byte(input))
+		if !errors.Is(err, ErrReturn) {
+			t.Errorf("expected ErrReturn, got %v", err)
+		}
+	}
+}
+
+func TestKeywordNames(t *testing.T) {
+	words := []string{"not", "set", "assign", "while", "endwhile", "extends", "import", "from", "as", "return", "end", "try", "catch", "endtry"}
+
+	for _, word := range words {
+		cc := NewCompileContext()
+		templates := map[string]string{
+			"declare": `${declare(W, 1)}$W`,
+			"block":   `${block(f, W)}$W${endblock f(2)}`,
+			"for":     `${for W in [3] do}$W${endfor}`,
+			"lambda":  `${declare(g, (W) => "$W") g(4)}`,
+		}
+		for name, tpl := range templates {
+			err := cc.ParseTemplate(name, []byte(strings.ReplaceAll(tpl, "W", word)))
+			if err != nil {
+				t.Fatalf("%s as %s: %v", word, name, err)
+			}
+		}
+		_, c := cc.Compile()
+
+		for name, expected := range map[string]string{"declare": "1", "block": "2", "for": "3", "lambda": "4"} {
+			result, err := c.EvalTemplateString(name, nil)
+			if err != nil {
+				t.Errorf("%s as %s: %v", word, name, err)
+			} else if result != expected {
+				t.Errorf("%s as %s: expected %s, got %s", word, name, expected, result)
+			}
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	testCases := []struct {
+		input string
+		err   error
+	}{
+		{`${xs[3]}`, ErrIndexOutOfRange},
+		{`${xs[-4]}`, ErrIndexOutOfRange},
+		{`${"abc"[3]}`, ErrIndexOutOfRange},
+		{`${[][0]}`, ErrIndexOutOfRange},
+		{`${it[0]}`, &ErrType{}},
+		{`${xs["a"]}`, &ErrType{}},
+		{`${xs[0.5]}`, nil},
+		{`${1[0]}`, &ErrType{}},
+		{`${{}[0:1]}`, &ErrType{}},
+		{`${1 / 0}`, ErrDivisionByZero},
+		{`${1 // 0}`, ErrDivisionByZero},
+		{`${1 % 0}`, ErrDivisionByZero},
+		{`${-"a"}`, &ErrType{}},
+		{`${"a" * 2}`, &ErrType{}},
+		{`${1 in 2}`, &ErrType{}},
+		{`${1 in n}`, &ErrType{}},
+		{`${for a, b in [[1, 2, 3]] do a endfor}`, ErrUnpack},
+		{`${for a, b in [1] do a endfor}`, ErrUnpack},
+		{`${block(f, a, b = 1)}${endblock f(b => 2)}`, ErrArgMissing},
+		{`${block(f, a)}${endblock f(1, a => 2)}`, ErrArgDuplicate},
+		{`${block(f, a)}${endblock f(1, b => 2)}`, ErrArgUnknown},
+		{`${declare(f, () => "") f(a => 1)}`, ErrArgUnknown},
+		{`${fn(s => "x")}`, ErrArgUnknown},
+		{`${"a" |> fn(s => "x")}`, ErrArgUnknown},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Eval %s", testCase.input)
+
+		cc := NewCompileContext()
+		err := cc.ParseTemplate("index", []byte(testCase.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, c := cc.Compile()
+		vars := Vars{
+			"xs": ListValue{NumberValue(1), NumberValue(2), NumberValue(3)},
+			"it": IterValue{&listIter{[]Value{NumberValue(1)}}},
+			"fn": FuncValue(BuiltinList),
+		}
+		_, err = c.EvalTemplateString("index", vars)
+
+		var typeErr *ErrType
+		switch {
+		case err == nil:
+			t.Errorf("expected an error")
+		case testCase.err == nil:
+		case errors.As(testCase.err, &typeErr):
+			if !errors.As(err, &typeErr) {
+				t.Errorf("expected a type error, got %v", err)
+			}
+		case !errors.Is(err, testCase.err):
+			t.Errorf("expected %v, got %v", testCase.err, err)
+		}
+	}
+}
+
+func TestIndexErrorMessage(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("index", []byte(`${xs[-4]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := cc.Compile()
+
+	_, err = c.EvalTemplateString("index", Vars{"xs": ListValue{NumberValue(1), NumberValue(2), NumberValue(3)}})
+	if err == nil || !strings.Contains(err.Error(), "index -4 with length 3") {
+		t.Errorf("expected the original index in the error, got %v", err)
+	}
+}
+
+func TestOptionalNameError(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("optional", []byte(`${user?.profile?.name ?? "anonymous"}${user?.x?.y}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cc.ParseTemplate("strict", []byte(`${user.x}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, c := cc.Compile()
+	c.NameError = func(name string) (Value, error) {
+		return nil, fmt.Errorf("undefined: %s", name)
+	}
+
+	for _, user := range []Value{Nil, ObjectValue{}} {
+		result, err := c.EvalTemplateString("optional", Vars{"user": user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "anonymous" {
+			t.Errorf("expected anonymous, got %q", result)
+		}
+	}
+
+	_, err = c.EvalTemplateString("strict", Vars{"user": ObjectValue{}})
+	if err == nil {
+		t.Error("expected a name error")
+	}
+}
+
+func TestAssignError(t *testing.T) {
+	cc := NewCompileContext()
+	for _, input := range []string{
+		`${declare(x, 0) block(f) set x = 1 endblock}`,
+		`${for i in range(3) do declare(x, 0) declare(f, () => "${assign(x, 1)}") endfor}`,
+		`${for i in range(3) do set f = (n) => "${set i = n}" endfor}`,
+	} {
+		err := cc.ParseTemplate(input, []byte(input))
+		if !errors.Is(err, ErrAssignCaptured) {
+			t.Errorf("%s: expected ErrAssignCaptured, got %v", input, err)
+		}
+	}
+
+	err := cc.ParseTemplate("undeclared", []byte(`${set x = 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := cc.Compile()
+	_, err = c.EvalTemplateString("undeclared", nil)
+	var nameErr *ErrName
+	if !errors.As(err, &nameErr) || nameErr.Name != "x" {
+		t.Errorf("expected a name error for x, got %v", err)
+	}
+}
+
+func TestExtendsError(t *testing.T) {
+	testCases := []struct {
+		templates map[string]string
+		err       error
+	}{
+		{map[string]string{"a": `${extends "b"}`}, ErrParentNotFound},
+		{map[string]string{"a": `${extends "b"}`, "b": `${extends "a"}`}, ErrExtendsCycle},
+		{map[string]string{"a": `${extends "a"}`}, ErrExtendsCycle},
+		{map[string]string{"a": `${extends "b" block(x)}${super()}${endblock}`, "b": `b`}, ErrSuperNotFound},
+		{map[string]string{"a": `${extends "b" extends "b"}`, "b": `b`}, ErrExtends},
+		{map[string]string{"a": `${if true then extends "b" endif}`, "b": `b`}, ErrExtends},
+		{map[string]string{"a": `${block(x) extends "b" endblock}`, "b": `b`}, ErrExtends},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Link %v", testCase.templates)
+
+		cc := NewCompileContext()
+		var err error
+		for name, src := range testCase.templates {
+			err = cc.ParseTemplate(name, []byte(src))
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = cc.Link()
+		}
+		if !errors.Is(err, testCase.err) {
+			t.Errorf("expected %v, got %v", testCase.err, err)
+		}
+	}
+
+	// Compile records the error, rendering the template fails as well
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("a", []byte(`${extends "b"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := cc.Compile()
+	if !errors.Is(cc.Err(), ErrParentNotFound) {
+		t.Errorf("expected ErrParentNotFound from Compile, got %v", cc.Err())
+	}
+	_, err = c.EvalTemplateString("a", nil)
+	if !errors.Is(err, ErrParentNotFound) {
+		t.Errorf("expected ErrParentNotFound, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	cc := NewCompileContext()
+	templates := map[string]string{
+		"lib":    `${count() block(hello, name)}Hello $name${endblock declare(x, 1) declare(x, 2)}`,
+		"main":   `${import "lib" as a for i in range(2) do from "lib" import hello endfor from "lib" import hello hello(a.x) include("other")}`,
+		"other":  `${import "lib" as b} ${b.hello(b.x)}`,
+		"cycle":  `${import "cycle2" as c}`,
+		"cycle2": `${from "cycle" import c}`,
+	}
+	for name, src := range templates {
+		err := cc.ParseTemplate(name, []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, c := cc.Compile()
+	count := 0
+	c.Declare("count", FuncValue(func(args Args) (Value, error) {
+		count++
+		return Nil, nil
+	}))
+
+	for i := 1; i <= 2; i++ {
+		result, err := c.EvalTemplateString("main", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != "Hello 2 Hello 2" {
+			t.Errorf("expected 'Hello 2 Hello 2', got '%s'", result)
+		}
+		// lib is imported once per render
+		if count != i {
+			t.Errorf("expected %d imports, got %d", i, count)
+		}
+	}
+
+	_, err := c.EvalTemplateString("cycle", nil)
+	if !errors.Is(err, ErrImportCycle) {
+		t.Errorf("expected ErrImportCycle, got %v", err)
+	}
+}
+
+func TestTry(t *testing.T) {
+	cc := NewCompileContext()
+	templates := map[string]string{
+		"page.txt":   "${try}<${include('widget.txt')}>${catch err}${err.template}:${err.line}: ${err.message}${endtry}",
+		"widget.txt": "ok\n${error('broken')}",
+		"raise.txt":  "${try}${error('a')}${catch err}${error(err.message + 'b', 'custom')}${endtry}",
+		"limit.txt":  "${try while true do 1 endwhile catch err 'caught' endtry}",
+		"lazy.txt":   "${try declare(r, [1].map((x) => do error('boom') end)) r catch e e.message endtry}",
+		"output.txt": "${try for i in range(100) do 'hello world' endfor catch err 'caught' endtry}",
+		"short.txt":  "${try 'hello' endtry}",
+	}
+	for name, src := range templates {
+		err := cc.ParseTemplate(name, []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, c := cc.Compile()
+	AddBuiltins(&c)
+
+	result, err := c.EvalTemplateString("page.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "widget.txt:2: broken"; result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+
+	_, err = c.EvalTemplateString("raise.txt", nil)
+	var raised *ErrRaised
+	if !errors.As(err, &raised) {
+		t.Fatalf("expected an *ErrRaised, got %v", err)
+	}
+	if raised.Message != "ab" || raised.Kind != "custom" {
+		t.Errorf("expected ab (custom), got %s (%s)", raised.Message, raised.Kind)
+	}
+
+	// exceeded limits are not caught
+	_, err = c.EvalTemplateString("limit.txt", nil)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded, got %v", err)
+	}
+
+	// lazy values are evaluated inside the try
+	result, err = c.EvalTemplateString("lazy.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "boom" {
+		t.Errorf("expected boom, got %q", result)
+	}
+
+	// buffered output counts towards the output limit, but only once
+	c.Limits.MaxOutputBytes = 5
+	err = c.EvalTemplateWriter("output.txt", nil, io.Discard)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded, got %v", err)
+	}
+	err = c.EvalTemplateWriter("short.txt", nil, io.Discard)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	errFail := errors.New("fail")
+
+	cc := NewCompileContext()
+	templates := map[string]string{
+		"main.txt":    "Hello\n${include('partial.txt')}",
+		"partial.txt": "${block(card, v)}\n  ${fail(v)}${endblock}\n${card(1)}",
+		"extends.txt": "Hello\n${include('child.txt')}",
+		"child.txt":   "${extends 'partial.txt'}",
+	}
+	for name, src := range templates {
+		err := cc.ParseTemplate(name, []byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, c := cc.Compile()
+	c.Declare("fail", FuncValue(func(args Args) (Value, error) {
+		return nil, errFail
+	}))
+
+	testCases := []struct {
+		name     string
+		expected []Frame
+	}{
+		{"main.txt", []Frame{
+			{Template: "partial.txt", Name: "card", Pos: Pos{2, 5}},
+			{Template: "partial.txt", Pos: Pos{3, 3}},
+			{Template: "main.txt", Pos: Pos{2, 3}},
+		}},
+		{"extends.txt", []Frame{
+			{Template: "partial.txt", Name: "card", Pos: Pos{2, 5}},
+			{Template: "partial.txt", Pos: Pos{3, 3}},
+			{Template: "child.txt", Pos: Pos{1, 3}},
+			{Template: "extends.txt", Pos: Pos{2, 3}},
+		}},
+	}
+
+	for _, testCase := range testCases {
+		_, err := c.EvalTemplateString(testCase.name, nil)
+		if !errors.Is(err, errFail) {
+			t.Fatalf("expected errFail, got %v", err)
+		}
+
+		var re *RenderError
+		if !errors.As(err, &re) {
+			t.Fatalf("expected a *RenderError, got %T", err)
+		}
+
+		expected := testCase.expected
+		if len(re.Frames) != len(expected) {
+			t.Fatalf("expected %d frames, got %s", len(expected), err)
+		}
+		for i := range expected {
+			if re.Frames[i] != expected[i] {
+				t.Errorf("expected frame %s, got %s", expected[i], re.Frames[i])
+			}
+		}
+	}
+}
+
+func TestRenderErrorWrapped(t *testing.T) {
+	errFail := errors.New("fail")
+
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("main.txt", []byte("${block(f, fn)}${each(fn)}${endblock}\n${f((x) => \"${[x].map((y) => '${fail(y)}').join()}\")}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, c := cc.Compile()
+	AddBuiltins(&c)
+	c.Declare("fail", FuncValue(func(args Args) (Value, error) {
+		return nil, errFail
+	}))
+	c.Declare("each", FuncValue(func(args Args) (Value, error) {
+		_, err := args.Call(args.Get(0), NumberValue(1))
+		if err != nil {
+			return nil, fmt.Errorf("each: %w", err)
+		}
+		return Nil, nil
+	}))
+
+	_, err = c.EvalTemplateString("main.txt", nil)
+	if !errors.Is(err, errFail) {
+		t.Fatalf("expected errFail, got %v", err)
+	}
+
+	var re *RenderError
+	if !errors.As(err, &re) {
+		t.Fatalf("expected a *RenderError, got %T", err)
+	}
+
+	expected := []Frame{
+		{Template: "main.txt", Pos: Pos{2, 33}},
+		{Template: "main.txt", Pos: Pos{2, 44}},
+		{Template: "main.txt", Name: "f", Pos: Pos{1, 18}},
+		{Template: "main.txt", Pos: Pos{2, 3}},
+	}
+	if len(re.Frames) != len(expected) {
+		t.Fatalf("expected %d frames, got %s", len(expected), err)
+	}
+	for i := range expected {
+		if re.Frames[i] != expected[i] {
+			t.Errorf("expected frame %s, got %s", expected[i], re.Frames[i])
+		}
+	}
+
+	// the context added by each is kept, the frames are reported once
+	if msg := re.Err.Error(); msg != "each: fail" {
+		t.Errorf("expected 'each: fail', got %q", msg)
+	}
+	if n := strings.Count(err.Error(), "main.txt:2:44"); n != 1 {
+		t.Errorf("expected the frames once, got %s", err)
+	}
+}
+
+func TestContextScopes(t *testing.T) {
+	c := NewContext()
+	c.declareVars(Vars{"a": StringValue("a0"), "b": StringValue("b0")})
+	c.Declare("c", StringValue("c0"))
+
+	c.BeginScope()
+	c.Declare("a", StringValue("a1"))
+	closure := c.Clone()
+	c.Assign("b", StringValue("b1"))
+	c.Assign("c", StringValue("c1"))
+	c.Assign("d", StringValue("d1"))
+	c.EndScope()
+
+	expected := map[string]Value{"a": StringValue("a0"), "b": StringValue("b1"), "c": StringValue("c1"), "d": nil}
+	for name, value := range expected {
+		if v, _ := c.TryLookup(name); v != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, v)
+		}
+	}
+
+	expected = map[string]Value{"a": StringValue("a1"), "b": StringValue("b0"), "c": StringValue("c0"), "d": nil}
+	for name, value := range expected {
+		if v, _ := closure.TryLookup(name); v != value {
+			t.Errorf("expected %s to be %v in the closure, got %v", name, value, v)
+		}
+	}
+}
+
+func BenchmarkRenderTestdata(b *testing.B) {
+	fsys := os.DirFS("testdata")
+	store, err := BuildStore().
+		AddFS(fsys, "*.test.txt", "*.template.txt").
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	matches, err := fs.Glob(fsys, "*.test.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := testFileVars().Build()
+
+	for _, name := range matches {
+		b.Run(strings.TrimSuffix(name, ".test.txt"), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := store.Render(io.Discard, name, vars)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRenderLoop(b *testing.B) {
+	store, err := BuildStore().
+		AddFS(fstest.MapFS{"loop.txt": {Data: []byte(`${
+			for i in range(100) do
+				declare(x, i)
+				for j in range(10) do
+					if j > x then break endif
+					declare(y, x + j)
+				endfor
+			endfor
+		}`)}}, "*.txt").
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		err := store.Render(io.Discard, "loop.txt", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRenderLambda(b *testing.B) {
+	store, err := BuildStore().
+		AddFS(fstest.MapFS{"lambda.txt": {Data: []byte(`${
+			for i in range(100) do
+				declare(f, (x) => "${x}")
+				f(i)
+			endfor
+		}`)}}, "*.txt").
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := testFileVars().Build()
+
+	for i := 0; i < b.N; i++ {
+		err := store.Render(io.Discard, "lambda.txt", vars)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRenderIncludeLoop(b *testing.B) {
+	store, err := BuildStore().
+		AddFS(fstest.MapFS{
+			"loop.txt": {Data: []byte(`${for item in range(n) do include("row.txt") endfor}`)},
+			"row.txt":  {Data: []byte(`$item`)},
+		}, "*.txt").
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	vars := Vars{"n": NumberValue(8000)}
+
+	for i := 0; i < b.N; i++ {
+		err := store.Render(io.Discard, "loop.txt", vars)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package html
 
 import (
+	"bytes"
 	"io/fs"
 	"os"
 	"path"
@@ -178,3 +179,64 @@ func TestCompileFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestCompileBundle(t *testing.T) {
+	fsys := os.DirFS("testdata")
+	cc := tplexpr.NewCompileContext()
+	for _, glob := range []string{"*.test.html", "*.template.html"} {
+		matches, err := fs.Glob(fsys, glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fileName := range matches {
+			data, err := fs.ReadFile(fsys, fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = (&Plugin{}).ParseTemplate(fileName, data, &cc)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bundle := bytes.Buffer{}
+	err := tplexpr.WriteBundle(&bundle, &cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := tplexpr.BuildStore().
+		AddPlugin(&Plugin{}).
+		AddBundle(bundle.Bytes()).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := fs.Glob(fsys, "*.test.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileName := range matches {
+		t.Logf("eval template %s", fileName)
+
+		sb := strings.Builder{}
+		err = store.Render(&sb, fileName, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		resultFileName := strings.Replace(fileName, ".test.html", ".result.html", 1)
+		expectedBytes, err := os.ReadFile(path.Join("testdata", resultFileName))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		expected := strings.ReplaceAll(string(expectedBytes), "\r\n", "\n")
+
+		if sb.String() != expected {
+			t.Errorf("%s: bundle output differs from the expected result", fileName)
+		}
+	}
+}
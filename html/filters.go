@@ -5,6 +5,11 @@ import (
 	"golang.org/x/net/html"
 )
 
+func init() {
+	tplexpr.RegisterValueFilter("html.escape", HtmlEscapeFilter)
+	tplexpr.RegisterValueFilter("html.comment", CommentEscapeFilter)
+}
+
 type htmlEscapeFilter struct{}
 
 var HtmlEscapeFilter tplexpr.ValueFilter = htmlEscapeFilter{}
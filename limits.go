@@ -0,0 +1,142 @@
+package tplexpr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits restricts the resources a single render may use. A zero field
+// means that there is no limit, except for MaxWhileIterations.
+type Limits struct {
+	MaxInstructions    int // executed instructions, including builtin iterations
+	MaxCallDepth       int // nested templates, blocks and lambdas
+	MaxOutputBytes     int // bytes written to the output
+	MaxListSize        int // length of lists built by literals, builtins and operators
+	MaxStringSize      int // length of strings produced by builtins and operators
+	MaxWhileIterations int // iterations of a single while loop, negative for no limit
+}
+
+// DefaultMaxWhileIterations is used if Limits.MaxWhileIterations is zero,
+// so a while loop whose condition never becomes false can not hang a
+// render.
+const DefaultMaxWhileIterations = 100000
+
+var ErrLimitExceeded = errors.New("limit exceeded")
+
+func limitError(name string, max int) error {
+	return fmt.Errorf("%w: %s (%d)", ErrLimitExceeded, name, max)
+}
+
+func (e *execState) enter() error {
+	e.depth++
+	if e.limits.MaxCallDepth > 0 && e.depth > e.limits.MaxCallDepth {
+		e.depth--
+		return limitError("max call depth", e.limits.MaxCallDepth)
+	}
+	return nil
+}
+
+func (e *execState) leave() {
+	e.depth--
+}
+
+func (e *execState) write(n int) error {
+	e.output += n
+	if e.limits.MaxOutputBytes > 0 && e.output > e.limits.MaxOutputBytes {
+		return limitError("max output bytes", e.limits.MaxOutputBytes)
+	}
+	return nil
+}
+
+func (e *execState) checkValue(v Value) error {
+	switch v := v.(type) {
+	case ListValue:
+		return e.checkListSize(len(v))
+	case StringValue:
+		return e.checkStringSize(len(v))
+	}
+	return nil
+}
+
+// checkListSize checks the length of a list before it is built. e may be
+// nil, if there are no limits.
+func (e *execState) checkListSize(n int) error {
+	if e != nil && e.limits.MaxListSize > 0 && n > e.limits.MaxListSize {
+		return limitError("max list size", e.limits.MaxListSize)
+	}
+	return nil
+}
+
+// checkStringSize checks the length of a string before it is built. e may
+// be nil, if there are no limits.
+func (e *execState) checkStringSize(n int) error {
+	if e != nil && e.limits.MaxStringSize > 0 && n > e.limits.MaxStringSize {
+		return limitError("max string size", e.limits.MaxStringSize)
+	}
+	return nil
+}
+
+// checkConcat checks the size of a + b before it is built.
+func (e *execState) checkConcat(a, b Value) error {
+	switch a := a.(type) {
+	case ListValue:
+		// b is appended as a single item
+		return e.checkListSize(len(a) + 1)
+	case StringValue:
+		if b, ok := b.(StringValue); ok {
+			return e.checkStringSize(len(a) + len(b))
+		}
+	}
+	return nil
+}
+
+// list converts v to a list. An iterator is consumed only until the list
+// grows beyond MaxListSize, instead of materializing it first.
+func (e *execState) list(v Value) ([]Value, error) {
+	if v.Kind() != KindIterator || e == nil {
+		lst, err := v.List()
+		if err == nil {
+			err = e.checkListSize(len(lst))
+		}
+		return lst, err
+	}
+
+	it, err := iterContext(e.ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	lst := []Value{}
+	for i := 0; i < IterListLimit; i++ {
+		item, err := it.Next()
+		if err != nil {
+			if err == ErrIterExhausted {
+				return lst, nil
+			}
+			return nil, err
+		}
+		if err := e.checkListSize(len(lst) + 1); err != nil {
+			return nil, err
+		}
+		lst = append(lst, item)
+	}
+	return lst, ErrIterListLimit
+}
+
+// loopGuard counts an iteration of the while loop whose iteration count
+// is in slot.
+func (c *Context) loopGuard(slot int) error {
+	n := 1
+	if v, ok := c.local(slot).(NumberValue); ok {
+		n = int(v) + 1
+	}
+	c.setLocal(slot, NumberValue(n))
+
+	max := DefaultMaxWhileIterations
+	if c.exec != nil && c.exec.limits.MaxWhileIterations != 0 {
+		max = c.exec.limits.MaxWhileIterations
+	}
+	if max > 0 && n > max {
+		return limitError("max while iterations", max)
+	}
+	return nil
+}
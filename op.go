@@ -1,6 +1,28 @@
 package tplexpr
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	ErrIndexOutOfRange = errors.New("index out of range")
+	ErrDivisionByZero  = errors.New("division by zero")
+	ErrUnpack          = errors.New("can not unpack")
+)
+
 func compareValues(a, b Value, cmp int) (ok bool, err error) {
+	switch cmp {
+	case IN:
+		return containsValue(context.Background(), b, a)
+	case NOTIN:
+		ok, err = containsValue(context.Background(), b, a)
+		return !ok, err
+	}
+
 	if a.Kind() != b.Kind() {
 		switch cmp {
 		case NE:
@@ -124,7 +146,7 @@ func binaryOPValues(a, b Value, op int) (Value, error) {
 	}
 
 returnError:
-	return nil, &ErrType{opAdd, a.Kind().String(), conTO, b.Kind().String()}
+	return nil, binaryOPError(a, b, op)
 
 handleString:
 	{
@@ -162,8 +184,25 @@ handleNumber:
 			v = l - r
 		case MUL:
 			v = l * r
-		case DIV:
-			v = l / r
+		case DIV, MOD, FLOORDIV:
+			if r == 0 {
+				return nil, ErrDivisionByZero
+			}
+			switch op {
+			case DIV:
+				v = l / r
+			case MOD:
+				// the result has the sign of the divisor, so that
+				// l == r * (l // r) + l % r
+				v = math.Mod(l, r)
+				if v != 0 && (v < 0) != (r < 0) {
+					v += r
+				}
+			case FLOORDIV:
+				v = math.Floor(l / r)
+			}
+		case POW:
+			v = math.Pow(l, r)
 		}
 		return NumberValue(v), nil
 	}
@@ -237,3 +276,236 @@ handleObject:
 		return res, nil
 	}
 }
+
+// containsValue reports whether v is an item of a list or an iterator, a
+// substring of a string or a key of an object. Iterators stop with the
+// error of ctx once it is done.
+func containsValue(ctx context.Context, container, v Value) (bool, error) {
+	switch container.Kind() {
+	case KindList, KindIterator:
+		it, err := iterContext(ctx, container)
+		if err != nil {
+			return false, err
+		}
+		for {
+			item, err := it.Next()
+			if err == ErrIterExhausted {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+			ok, err := compareValues(item, v, EQ)
+			if ok || err != nil {
+				return ok, err
+			}
+		}
+	case KindString:
+		s, err := container.String()
+		if err != nil {
+			return false, err
+		}
+		sub, err := v.String()
+		if err != nil {
+			return false, err
+		}
+		return strings.Contains(s, sub), nil
+	case KindObject:
+		obj, err := container.Object()
+		if err != nil {
+			return false, err
+		}
+		key, err := v.String()
+		if err != nil {
+			return false, err
+		}
+		_, ok := obj.Key(key)
+		return ok, nil
+	}
+	return false, &ErrType{opSearch, v.Kind().String(), conIN, container.Kind().String()}
+}
+
+func binaryOPError(a, b Value, op int) error {
+	aKind, bKind := a.Kind().String(), b.Kind().String()
+	switch op {
+	case SUB:
+		return &ErrType{opSub, bKind, conFROM, aKind}
+	case MUL:
+		return &ErrType{opMul, aKind, conBY, bKind}
+	case DIV, FLOORDIV:
+		return &ErrType{opDiv, aKind, conBY, bKind}
+	case MOD:
+		return &ErrType{opMod, aKind, conBY, bKind}
+	case POW:
+		return &ErrType{opPow, aKind, conTO, bKind}
+	}
+	return &ErrType{opAdd, aKind, conTO, bKind}
+}
+
+// negateValue returns -v of a number.
+func negateValue(v Value) (Value, error) {
+	if v.Kind() != KindNumber {
+		return nil, &ErrType{opConvert, v.Kind().String(), conTO, KindNumberName}
+	}
+	n, err := v.Number()
+	if err != nil {
+		return nil, err
+	}
+	return NumberValue(-n), nil
+}
+
+// indexValue returns v[index]. ok is false if v is an object that does not
+// have the key. Iterators can not be indexed, since that would consume
+// them.
+func indexValue(v, index Value) (value Value, ok bool, err error) {
+	switch v.Kind() {
+	case KindList:
+		i, err := toIndex(v, index)
+		if err != nil {
+			return nil, false, err
+		}
+		if rl, isReflect := v.(reflectList); isReflect {
+			i, err = checkIndex(i, rl.rv.Len())
+			if err != nil {
+				return nil, false, err
+			}
+			return Reflect(rl.rv.Index(i).Interface()), true, nil
+		}
+		lst, err := v.List()
+		if err != nil {
+			return nil, false, err
+		}
+		i, err = checkIndex(i, len(lst))
+		if err != nil {
+			return nil, false, err
+		}
+		return lst[i], true, nil
+	case KindString:
+		i, err := toIndex(v, index)
+		if err != nil {
+			return nil, false, err
+		}
+		s, err := v.String()
+		if err != nil {
+			return nil, false, err
+		}
+		runes := []rune(s)
+		i, err = checkIndex(i, len(runes))
+		if err != nil {
+			return nil, false, err
+		}
+		return StringValue(runes[i]), true, nil
+	case KindObject:
+		key, err := index.String()
+		if err != nil {
+			return nil, false, err
+		}
+		obj, err := v.Object()
+		if err != nil {
+			return nil, false, err
+		}
+		value, ok = obj.Key(key)
+		return value, ok, nil
+	}
+	return nil, false, &ErrType{opIndex, v.Kind().String(), conBY, index.Kind().String()}
+}
+
+// sliceValue returns v[low:high] of a list or a string. Nil bounds default
+// to the start and the end, negative bounds count from the end and bounds
+// outside of v are clamped. An iterator is consumed into a list first.
+func sliceValue(exec *execState, v, low, high Value) (Value, error) {
+	switch v.Kind() {
+	case KindList, KindIterator:
+		lst, err := exec.list(v)
+		if err != nil {
+			return nil, err
+		}
+		lo, hi, err := sliceBounds(v, low, high, len(lst))
+		if err != nil {
+			return nil, err
+		}
+		// limit the capacity, so appending to the slice does not modify v
+		return ListValue(lst[lo:hi:hi]), nil
+	case KindString:
+		s, err := v.String()
+		if err != nil {
+			return nil, err
+		}
+		runes := []rune(s)
+		lo, hi, err := sliceBounds(v, low, high, len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return StringValue(runes[lo:hi]), nil
+	}
+	return nil, &ErrType{opSlice, v.Kind().String(), conBY, low.Kind().String()}
+}
+
+// unpackValue destructures the list v into exactly n values.
+func unpackValue(v Value, n int) ([]Value, error) {
+	switch v.Kind() {
+	case KindList, KindIterator:
+	default:
+		return nil, fmt.Errorf("%w %s into %d variables", ErrUnpack, v.Kind(), n)
+	}
+	lst, err := v.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(lst) != n {
+		return nil, fmt.Errorf("%w %d values into %d variables", ErrUnpack, len(lst), n)
+	}
+	return lst, nil
+}
+
+func toIndex(v, index Value) (int, error) {
+	if index.Kind() != KindNumber {
+		return 0, &ErrType{opIndex, v.Kind().String(), conBY, index.Kind().String()}
+	}
+	f, err := index.Number()
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("index %g is not an integer", f)
+	}
+	return int(f), nil
+}
+
+func checkIndex(i, length int) (int, error) {
+	j := i
+	if j < 0 {
+		j += length
+	}
+	if j < 0 || j >= length {
+		return 0, fmt.Errorf("%w: index %d with length %d", ErrIndexOutOfRange, i, length)
+	}
+	return j, nil
+}
+
+func sliceBounds(v, low, high Value, length int) (lo, hi int, err error) {
+	lo, hi = 0, length
+	if low.Kind() != KindNil {
+		lo, err = toIndex(v, low)
+		if err != nil {
+			return
+		}
+	}
+	if high.Kind() != KindNil {
+		hi, err = toIndex(v, high)
+		if err != nil {
+			return
+		}
+	}
+	lo, hi = clampBound(lo, length), clampBound(hi, length)
+	if hi < lo {
+		hi = lo
+	}
+	return
+}
+
+func clampBound(i, length int) int {
+	if i < 0 {
+		i += length
+	}
+	return min(max(i, 0), length)
+}
@@ -2,6 +2,7 @@ package tplexpr
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -9,6 +10,7 @@ import (
 type Parser struct {
 	s         Scanner
 	lookahead []Token
+	prevEnd   int // end of the last consumed token
 }
 
 func NewParser(input []byte) Parser {
@@ -17,6 +19,14 @@ func NewParser(input []byte) Parser {
 	}
 }
 
+// newSubParser creates a parser for a string literal, so that positions
+// are reported relative to the enclosing template.
+func (p *Parser) newSubParser(t Token) Parser {
+	return Parser{
+		s: newSubScanner(&p.s, t),
+	}
+}
+
 func (p *Parser) lookAhead(n int) Token {
 	for {
 		if n < len(p.lookahead) {
@@ -40,6 +50,7 @@ func (p *Parser) getToken() (t Token) {
 }
 
 func (p *Parser) consume() {
+	p.prevEnd = p.lookahead[0].End
 	if len(p.lookahead) == 1 {
 		p.lookahead = p.lookahead[:0]
 	} else {
@@ -47,15 +58,37 @@ func (p *Parser) consume() {
 	}
 }
 
-func (p *Parser) errUnexpected(expected string) error {
+func (p *Parser) pos(t Token) Pos {
+	return p.s.position(t.Start)
+}
+
+func (p *Parser) tokenText(t Token) string {
+	if t.Start < 0 || t.End > len(p.s.input) || t.Start > t.End {
+		return ""
+	}
+	return string(p.s.input[t.Start:t.End])
+}
+
+func (p *Parser) errorAt(t Token, msg string, expected ...string) error {
+	pos := p.s.position(t.Start)
+	return &ParseError{
+		Line:     pos.Line,
+		Column:   pos.Column,
+		Token:    p.tokenText(t),
+		Expected: expected,
+		Msg:      msg,
+	}
+}
+
+func (p *Parser) errUnexpected(expected ...string) error {
 	t := p.getToken()
 	if t.Type == TokenError {
 		return p.s.Err
 	}
-	if len(expected) > 0 {
-		return fmt.Errorf("%w: unexpected token %s. Expected %s", ErrSyntax, t.Type, expected)
+	if t.Type == TokenEOF {
+		return p.errorAt(t, "unexpected EOF", expected...)
 	}
-	return fmt.Errorf("%w: unexpected token %s", ErrSyntax, t.Type)
+	return p.errorAt(t, fmt.Sprintf("unexpected token %s %q", t.Type, p.tokenText(t)), expected...)
 }
 
 func (p *Parser) parseAtom() (n Node, err error) {
@@ -64,17 +97,21 @@ func (p *Parser) parseAtom() (n Node, err error) {
 	switch t.Type {
 	case TokenIdent:
 		p.consume()
-		n = &VarNode{string(t.Value)}
+		n = &VarNode{Name: string(t.Value), Pos: p.pos(t)}
 		return
 	case TokenString:
 		p.consume()
-		subp := NewParser(t.Value)
+		subp := p.newSubParser(t)
 		n, err = subp.Parse()
 		return
 	case TokenNumber:
 		p.consume()
 		value := string(t.Value)
 		_, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			err = p.errorAt(t, fmt.Sprintf("invalid number %s", value))
+			return
+		}
 		n = &NumberNode{value}
 		return
 	case TokenObject:
@@ -94,7 +131,7 @@ func (p *Parser) parseAtom() (n Node, err error) {
 			return
 		}
 		var extend Node
-		if p.getToken().Type != TokenIdent || p.lookAhead(1).Type != TokenArrow {
+		if !isName(p.getToken()) || p.lookAhead(1).Type != TokenArrow {
 			extend, err = p.ParseExpr()
 			if err != nil {
 				return
@@ -108,7 +145,7 @@ func (p *Parser) parseAtom() (n Node, err error) {
 			case TokenComma:
 				p.consume()
 			default:
-				err = p.errUnexpected(", | )")
+				err = p.errUnexpected(",", ")")
 				return
 			}
 		}
@@ -119,7 +156,7 @@ func (p *Parser) parseAtom() (n Node, err error) {
 			if t.Type == TokenRightParen {
 				break
 			}
-			if t.Type != TokenIdent {
+			if !isName(t) {
 				err = p.errUnexpected("identifier")
 				return
 			}
@@ -139,7 +176,7 @@ func (p *Parser) parseAtom() (n Node, err error) {
 				return
 			}
 
-			keys = append(keys, ObjectKey{key, value})
+			keys = append(keys, ObjectKey{Key: key, Value: value})
 
 			t = p.getToken()
 			if t.Type != TokenComma {
@@ -154,12 +191,24 @@ func (p *Parser) parseAtom() (n Node, err error) {
 		p.consume()
 		n = &ObjectNode{extend, keys}
 		return
+	case TokenLeftBracket:
+		n, err = p.parseList()
+		return
+	case TokenLeftBrace:
+		n, err = p.parseObject()
+		return
 	case TokenIf:
 		n, err = p.parseIf()
 		return
 	case TokenFor:
 		n, err = p.parseFor()
 		return
+	case TokenTry:
+		n, err = p.parseTry()
+		return
+	case TokenWhile:
+		n, err = p.parseWhile()
+		return
 	case TokenInclude:
 		n, err = p.parseInclude()
 		return
@@ -186,28 +235,16 @@ func (p *Parser) parseAtom() (n Node, err error) {
 		}
 
 		if afterParen.Type == TokenArrow {
-			args := []string{}
 			p.consume()
-			for {
-				t = p.getToken()
-				if t.Type == TokenRightParen {
-					break
-				}
-				if t.Type != TokenIdent {
-					err = p.errUnexpected("identifier")
-					return
-				}
-				args = append(args, string(t.Value))
-				p.consume()
-
-				t = p.getToken()
-				if t.Type != TokenComma {
-					break
-				}
-				p.consume()
+			var args []string
+			var params Params
+			args, params, err = p.parseParams()
+			if err != nil {
+				return
 			}
 
 			// consume the closing brace
+			t = p.getToken()
 			if t.Type != TokenRightParen {
 				err = p.errUnexpected(")")
 				return
@@ -222,20 +259,30 @@ func (p *Parser) parseAtom() (n Node, err error) {
 			}
 			p.consume()
 
-			// consume the string
+			// consume the body, a string or do ... end
 			t = p.getToken()
-			if t.Type != TokenString {
-				err = p.errUnexpected("string")
-				return
-			}
-			p.consume()
-
-			subp := NewParser(t.Value)
-			n, err = subp.Parse()
-			if err != nil {
+			switch t.Type {
+			case TokenString:
+				p.consume()
+				subp := p.newSubParser(t)
+				n, err = subp.Parse()
+				if err != nil {
+					return
+				}
+			case TokenDo:
+				p.consume()
+				var stmts []Node
+				stmts, err = p.parseStmtList(lambdaEndTokens)
+				if err != nil {
+					return
+				}
+				p.consume()
+				n = &CompoundNode{Nodes: stmts}
+			default:
+				err = p.errUnexpected("string", "do")
 				return
 			}
-			n = &SubprogNode{args, n}
+			n = &SubprogNode{Args: args, Params: params, Prog: n}
 		} else {
 			p.consume()
 			n, err = p.ParseExpr()
@@ -251,18 +298,140 @@ func (p *Parser) parseAtom() (n Node, err error) {
 		}
 		return
 	default:
-		err = p.errUnexpected("")
+		if isIdent(t) {
+			p.consume()
+			n = &VarNode{Name: string(t.Value), Pos: p.pos(t)}
+			return
+		}
+		err = p.errUnexpected()
 		return
 
 	}
 }
 
+var lambdaEndTokens = map[TokenType]bool{
+	TokenEnd: true,
+}
+
+// parseList parses a list literal: [a, b, c]
+func (p *Parser) parseList() (n Node, err error) {
+	p.consume()
+
+	items := []Node{}
+	for {
+		t := p.getToken()
+		if t.Type == TokenRightBracket {
+			break
+		}
+
+		var item Node
+		item, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+		items = append(items, item)
+
+		if p.getToken().Type != TokenComma {
+			break
+		}
+		p.consume()
+	}
+
+	if p.getToken().Type != TokenRightBracket {
+		err = p.errUnexpected(",", "]")
+		return
+	}
+	p.consume()
+	n = &ListNode{items}
+	return
+}
+
+// parseObject parses an object literal: {a: 1, "b-c": 2, [key]: 3}
+func (p *Parser) parseObject() (n Node, err error) {
+	p.consume()
+
+	keys := []ObjectKey{}
+	for {
+		t := p.getToken()
+		if t.Type == TokenRightBrace {
+			break
+		}
+
+		key := ObjectKey{}
+		switch {
+		case isName(t):
+			p.consume()
+			key.Key = string(t.Value)
+		case t.Type == TokenString:
+			p.consume()
+			subp := p.newSubParser(t)
+			var keyNode Node
+			keyNode, err = subp.Parse()
+			if err != nil {
+				return
+			}
+			if v, ok := keyNode.(*ValueNode); ok {
+				key.Key = v.Value
+			} else {
+				key.KeyExpr = keyNode
+			}
+		case t.Type == TokenLeftBracket:
+			p.consume()
+			key.KeyExpr, err = p.ParseExpr()
+			if err != nil {
+				return
+			}
+			if p.getToken().Type != TokenRightBracket {
+				err = p.errUnexpected("]")
+				return
+			}
+			p.consume()
+		default:
+			err = p.errUnexpected("identifier", "string", "[", "}")
+			return
+		}
+
+		if p.getToken().Type != TokenColon {
+			err = p.errUnexpected(":")
+			return
+		}
+		p.consume()
+
+		key.Value, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+		keys = append(keys, key)
+
+		if p.getToken().Type != TokenComma {
+			break
+		}
+		p.consume()
+	}
+
+	if p.getToken().Type != TokenRightBrace {
+		err = p.errUnexpected(",", "}")
+		return
+	}
+	p.consume()
+	n = &ObjectNode{Keys: keys}
+	return
+}
+
 func (p *Parser) parsePostfix() (n Node, err error) {
 	n, err = p.parseAtom()
 	if err != nil {
 		return
 	}
 
+	// an optional access short-circuits the rest of the chain
+	optional := false
+	defer func() {
+		if err == nil && optional {
+			n = &OptionalChainNode{n}
+		}
+	}()
+
 	for {
 		t := p.getToken()
 
@@ -275,31 +444,31 @@ func (p *Parser) parsePostfix() (n Node, err error) {
 			}
 
 			if v, ok := n.(*VarNode); ok {
-				n = &CallNode{v.Name, args}
+				n = &CallNode{Name: v.Name, Args: args, Pos: v.Pos}
 			} else {
-				n = &DynCallNode{n, args}
+				n = &DynCallNode{Value: n, Args: args, Pos: p.pos(t)}
+			}
+		case TokenLeftBracket:
+			// the subscript must follow the operand directly, otherwise
+			// ${a [b]} and ${a}${[b]} would be parsed as a[b]
+			if t.Start != p.prevEnd {
+				return
+			}
+			n, err = p.parseSubscript(n)
+			if err != nil {
+				return
 			}
-		case TokenDot:
+		case TokenDot, TokenOptionalDot:
 			p.consume()
+			optionalDot := t.Type == TokenOptionalDot
+			if optionalDot {
+				n = &OptionalNode{n}
+				optional = true
+			}
 			t = p.getToken()
 
-			switch t.Type {
-			case TokenIdent:
-				name := string(t.Value)
-				p.consume()
-
-				t = p.getToken()
-				if t.Type == TokenLeftParen {
-					var args []Node
-					args, err = p.parseArgList()
-					if err != nil {
-						return
-					}
-					n = &CallNode{name, append([]Node{n}, args...)}
-				} else {
-					n = &AttrNode{n, name}
-				}
-			case TokenThen:
+			switch {
+			case t.Type == TokenThen:
 				p.consume()
 				var args []Node
 				args, err = p.parseArgList()
@@ -323,11 +492,27 @@ func (p *Parser) parsePostfix() (n Node, err error) {
 						Alt:  args[1],
 					}
 				default:
-					err = fmt.Errorf("%w: .then reiquires 0 to 2 arguments", ErrSyntax)
+					err = p.errorAt(t, ".then requires 0 to 2 arguments")
 				}
 				return
+			case isName(t):
+				name := string(t.Value)
+				pos := p.pos(t)
+				p.consume()
+
+				t = p.getToken()
+				if t.Type == TokenLeftParen {
+					var args []Node
+					args, err = p.parseArgList()
+					if err != nil {
+						return
+					}
+					n = &CallNode{Name: name, Args: append([]Node{n}, args...), Pos: pos, Method: true}
+				} else {
+					n = &AttrNode{Expr: n, Name: name, Pos: pos, Optional: optionalDot}
+				}
 			default:
-				err = p.errUnexpected("")
+				err = p.errUnexpected()
 				return
 			}
 		default:
@@ -337,6 +522,84 @@ func (p *Parser) parsePostfix() (n Node, err error) {
 	}
 }
 
+// isName reports whether t can be used as an attribute name or an object
+// key. Keywords are names there, so data keys like end or from stay usable.
+func isName(t Token) bool {
+	if t.Type == TokenIdent {
+		return true
+	}
+	tt, ok := keywordMap[string(t.Value)]
+	return ok && tt == t.Type
+}
+
+// contextualKeywords are keywords that are only special where their
+// statement or operator expects them. Everywhere else they are names, so
+// templates using them as variables keep working.
+var contextualKeywords = map[TokenType]bool{
+	TokenNot:      true,
+	TokenAssign:   true,
+	TokenSet:      true,
+	TokenWhile:    true,
+	TokenEndWhile: true,
+	TokenExtends:  true,
+	TokenImport:   true,
+	TokenFrom:     true,
+	TokenAs:       true,
+	TokenReturn:   true,
+	TokenEnd:      true,
+	TokenTry:      true,
+	TokenCatch:    true,
+	TokenEndTry:   true,
+}
+
+// isIdent reports whether t can be used as a variable or parameter name.
+func isIdent(t Token) bool {
+	return t.Type == TokenIdent || contextualKeywords[t.Type]
+}
+
+// parseSubscript parses expr[index] and expr[low:high].
+func (p *Parser) parseSubscript(expr Node) (n Node, err error) {
+	pos := p.pos(p.getToken())
+	p.consume()
+
+	var low, high Node
+	if p.getToken().Type != TokenColon {
+		low, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+	}
+
+	t := p.getToken()
+	switch t.Type {
+	case TokenRightBracket:
+		p.consume()
+		n = &IndexNode{Expr: expr, Index: low, Pos: pos}
+		return
+	case TokenColon:
+		p.consume()
+	default:
+		err = p.errUnexpected(":", "]")
+		return
+	}
+
+	if p.getToken().Type != TokenRightBracket {
+		high, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+	}
+	if p.getToken().Type != TokenRightBracket {
+		err = p.errUnexpected("]")
+		return
+	}
+	p.consume()
+	n = &SliceNode{Expr: expr, Low: low, High: high, Pos: pos}
+	return
+}
+
+// parseArgList parses the arguments of a call. Named arguments, name =>
+// value, follow the positional ones and are passed as a NamedArgsNode.
 func (p *Parser) parseArgList() (args []Node, err error) {
 	t := p.getToken()
 	if t.Type != TokenLeftParen {
@@ -345,18 +608,34 @@ func (p *Parser) parseArgList() (args []Node, err error) {
 	}
 	p.consume()
 
+	named := &NamedArgsNode{}
 	for {
 		t = p.getToken()
 		if t.Type == TokenRightParen {
 			break
 		}
 
-		var arg Node
-		arg, err = p.ParseExpr()
-		if err != nil {
+		if isIdent(t) && p.lookAhead(1).Type == TokenArrow {
+			named.Names = append(named.Names, string(t.Value))
+			p.consume()
+			p.consume()
+			var value Node
+			value, err = p.ParseExpr()
+			if err != nil {
+				return
+			}
+			named.Values = append(named.Values, value)
+		} else if len(named.Names) > 0 {
+			err = p.errorAt(t, "positional argument after named argument")
 			return
+		} else {
+			var arg Node
+			arg, err = p.ParseExpr()
+			if err != nil {
+				return
+			}
+			args = append(args, arg)
 		}
-		args = append(args, arg)
 
 		t = p.getToken()
 
@@ -372,6 +651,10 @@ func (p *Parser) parseArgList() (args []Node, err error) {
 		return
 	}
 	p.consume()
+
+	if len(named.Names) > 0 {
+		args = append(args, named)
+	}
 	return
 }
 
@@ -396,7 +679,7 @@ func (p *Parser) parseBinaryOP(defs map[TokenType]int, next func() (Node, error)
 		if err != nil {
 			return nil, err
 		}
-		ops = append(ops, BinaryOP{op, e})
+		ops = append(ops, BinaryOP{Op: op, Expr: e, Pos: p.pos(t)})
 	}
 
 	if len(ops) > 0 {
@@ -405,18 +688,111 @@ func (p *Parser) parseBinaryOP(defs map[TokenType]int, next func() (Node, error)
 	return
 }
 
+// parsePipe parses value |> f(a), which is the call f(value, a). The
+// right side may also be a name, a dynamic call or any other postfix
+// expression that evaluates to a function. Like a filter, the pipe binds
+// tighter than any other operator: -x |> f is -(x |> f).
+func (p *Parser) parsePipe() (n Node, err error) {
+	n, err = p.parsePostfix()
+	if err != nil {
+		return
+	}
+
+	for {
+		t := p.getToken()
+		if t.Type != TokenPipe {
+			return
+		}
+		p.consume()
+
+		var fn Node
+		fn, err = p.parsePostfix()
+		if err != nil {
+			return
+		}
+
+		switch fn := fn.(type) {
+		case *VarNode:
+			n = &CallNode{Name: fn.Name, Args: []Node{n}, Pos: fn.Pos}
+		case *CallNode:
+			if fn.Method {
+				// x |> o.f(a) calls the attribute f of o, not f(o, a)
+				attr := &AttrNode{Expr: fn.Args[0], Name: fn.Name, Pos: fn.Pos}
+				n = &DynCallNode{Value: attr, Args: append([]Node{n}, fn.Args[1:]...), Pos: fn.Pos}
+			} else {
+				n = &CallNode{Name: fn.Name, Args: append([]Node{n}, fn.Args...), Pos: fn.Pos}
+			}
+		case *DynCallNode:
+			n = &DynCallNode{Value: fn.Value, Args: append([]Node{n}, fn.Args...), Pos: fn.Pos}
+		default:
+			n = &DynCallNode{Value: fn, Args: []Node{n}, Pos: p.pos(t)}
+		}
+	}
+}
+
+// parsePower parses the right associative a ** b, which binds tighter
+// than a unary operator on its left: -a ** b is -(a ** b).
+func (p *Parser) parsePower() (n Node, err error) {
+	n, err = p.parsePipe()
+	if err != nil {
+		return
+	}
+
+	t := p.getToken()
+	if t.Type != TokenPOW {
+		return
+	}
+	p.consume()
+
+	exp, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	n = &BinaryOPNode{n, []BinaryOP{{Op: POW, Expr: exp, Pos: p.pos(t)}}}
+	return
+}
+
+func (p *Parser) parseUnary() (n Node, err error) {
+	t := p.getToken()
+	switch t.Type {
+	case TokenNOT:
+		p.consume()
+		n, err = p.parseUnary()
+		if err != nil {
+			return
+		}
+		n = &NotNode{n}
+	case TokenSUB:
+		p.consume()
+		n, err = p.parseUnary()
+		if err != nil {
+			return
+		}
+		if num, ok := n.(*NumberNode); ok && !strings.HasPrefix(num.Value, "-") {
+			n = &NumberNode{"-" + num.Value}
+		} else {
+			n = &NegNode{n, p.pos(t)}
+		}
+	default:
+		n, err = p.parsePower()
+	}
+	return
+}
+
 var factorDefs = map[TokenType]int{
-	TokenMUL: MUL,
-	TokenDIV: DIV,
+	TokenMUL:      MUL,
+	TokenDIV:      DIV,
+	TokenMOD:      MOD,
+	TokenFLOORDIV: FLOORDIV,
 }
 
 func (p *Parser) parseFactor() (n Node, err error) {
-	return p.parseBinaryOP(factorDefs, p.parsePostfix)
+	return p.parseBinaryOP(factorDefs, p.parseUnary)
 }
 
 var termDefs = map[TokenType]int{
 	TokenADD: ADD,
-	TokenDIV: DIV,
+	TokenSUB: SUB,
 }
 
 func (p *Parser) parseTerm() (n Node, err error) {
@@ -444,6 +820,15 @@ func (p *Parser) parseCompare() (n Node, err error) {
 		cmp = LE
 	case TokenLT:
 		cmp = LT
+	case TokenIn:
+		cmp = IN
+	case TokenNot:
+		if p.lookAhead(1).Type != TokenIn {
+			// not is a name, unless it is followed by in
+			return
+		}
+		p.consume()
+		cmp = NOTIN
 	default:
 		return
 	}
@@ -454,7 +839,7 @@ func (p *Parser) parseCompare() (n Node, err error) {
 		return
 	}
 
-	n = &CompareNode{cmp, n, r}
+	n = &CompareNode{Compare: cmp, Left: n, Right: r, Pos: p.pos(t)}
 	return
 }
 
@@ -520,8 +905,31 @@ func (p *Parser) parseOR() (n Node, err error) {
 	return
 }
 
+func (p *Parser) parseCoalesce() (n Node, err error) {
+	n, err = p.parseOR()
+	if err != nil {
+		return
+	}
+
+	nodes := []Node{n}
+	for p.getToken().Type == TokenCoalesce {
+		p.consume()
+
+		n, err = p.parseOR()
+		if err != nil {
+			return
+		}
+		nodes = append(nodes, n)
+	}
+
+	if len(nodes) > 1 {
+		n = &CoalesceNode{nodes}
+	}
+	return
+}
+
 func (p *Parser) ParseExpr() (n Node, err error) {
-	return p.parseOR()
+	return p.parseCoalesce()
 }
 
 var templateEndTokens = map[TokenType]bool{
@@ -544,7 +952,7 @@ func (p *Parser) parseBlock() (n Node, err error) {
 	p.consume()
 
 	t = p.getToken()
-	if t.Type != TokenIdent {
+	if !isIdent(t) {
 		err = p.errUnexpected("identifier")
 		return
 	}
@@ -552,34 +960,19 @@ func (p *Parser) parseBlock() (n Node, err error) {
 	p.consume()
 
 	args := []string{}
+	params := Params{}
 
 	t = p.getToken()
 	if t.Type == TokenComma {
 		p.consume()
 
-		for {
-			t = p.getToken()
-			if t.Type == TokenRightParen {
-				break
-			}
-			if t.Type != TokenIdent {
-				err = p.errUnexpected("identifier | )")
-				return
-			}
-
-			arg := string(t.Value)
-			args = append(args, arg)
-			p.consume()
-
-			t = p.getToken()
-			if t.Type == TokenComma {
-				p.consume()
-			} else {
-				break
-			}
+		args, params, err = p.parseParams()
+		if err != nil {
+			return
 		}
 	}
 
+	t = p.getToken()
 	if t.Type != TokenRightParen {
 		err = p.errUnexpected(")")
 		return
@@ -592,10 +985,67 @@ func (p *Parser) parseBlock() (n Node, err error) {
 	}
 	p.consume()
 
-	n = &BlockNode{name, args, stmts}
+	n = &BlockNode{Name: name, Args: args, Params: params, Body: stmts}
 	return
 }
 
+// parseParams parses the parameters of a block or lambda up to the closing
+// paren: name, name = default, ...rest and **kwargs, in this order.
+func (p *Parser) parseParams() (args []string, params Params, err error) {
+	args = []string{}
+	for {
+		t := p.getToken()
+		if t.Type == TokenRightParen {
+			return
+		}
+		if params.Kwargs != "" {
+			err = p.errUnexpected(")")
+			return
+		}
+
+		kind := t.Type
+		if kind == TokenEllipsis || kind == TokenPOW {
+			p.consume()
+			t = p.getToken()
+		}
+		if !isIdent(t) {
+			err = p.errUnexpected("identifier")
+			return
+		}
+		name := string(t.Value)
+		p.consume()
+
+		switch {
+		case kind == TokenPOW:
+			params.Kwargs = name
+		case params.Rest != "":
+			err = p.errorAt(t, "parameter after ..."+params.Rest)
+			return
+		case kind == TokenEllipsis:
+			params.Rest = name
+		case p.getToken().Type == TokenEquals:
+			p.consume()
+			var def Node
+			def, err = p.ParseExpr()
+			if err != nil {
+				return
+			}
+			args = append(args, name)
+			params.Defaults = append(params.Defaults, def)
+		case len(params.Defaults) > 0:
+			err = p.errorAt(t, "parameter without default after one with default", "=")
+			return
+		default:
+			args = append(args, name)
+		}
+
+		if p.getToken().Type != TokenComma {
+			return
+		}
+		p.consume()
+	}
+}
+
 var ifEndTokens = map[TokenType]bool{
 	TokenElse:   true,
 	TokenElseIf: true,
@@ -672,6 +1122,11 @@ func (p *Parser) parseIf() (n Node, err error) {
 }
 
 var forEndTokenMap = map[TokenType]bool{
+	TokenElse:   true,
+	TokenEndFor: true,
+}
+
+var forElseEndTokenMap = map[TokenType]bool{
 	TokenEndFor: true,
 }
 
@@ -681,16 +1136,32 @@ func (p *Parser) parseFor() (n Node, err error) {
 		err = p.errUnexpected("for")
 		return
 	}
+	pos := p.pos(t)
 	p.consume()
 
 	t = p.getToken()
-	if t.Type != TokenIdent {
+	if !isIdent(t) {
 		err = p.errUnexpected("identifier")
 		return
 	}
 	varName := string(t.Value)
 	p.consume()
 
+	var vars []string
+	for p.getToken().Type == TokenComma {
+		p.consume()
+		if vars == nil {
+			vars = []string{varName}
+		}
+		t = p.getToken()
+		if !isIdent(t) {
+			err = p.errUnexpected("identifier")
+			return
+		}
+		vars = append(vars, string(t.Value))
+		p.consume()
+	}
+
 	t = p.getToken()
 	if t.Type != TokenIn {
 		err = p.errUnexpected("in")
@@ -714,9 +1185,92 @@ func (p *Parser) parseFor() (n Node, err error) {
 	if err != nil {
 		return
 	}
+	var alt []Node
+	if p.getToken().Type == TokenElse {
+		p.consume()
+		alt, err = p.parseStmtList(forElseEndTokenMap)
+		if err != nil {
+			return
+		}
+		if alt == nil {
+			alt = []Node{}
+		}
+	}
+	p.consume()
+
+	n = &ForNode{Var: varName, Vars: vars, Expr: expr, Body: body, Alt: alt, Pos: pos}
+	return
+}
+
+var whileEndTokenMap = map[TokenType]bool{
+	TokenEndWhile: true,
+}
+
+func (p *Parser) parseWhile() (n Node, err error) {
+	t := p.getToken()
+	pos := p.pos(t)
+	p.consume()
+
+	cond, err := p.ParseExpr()
+	if err != nil {
+		return
+	}
+
+	if p.getToken().Type != TokenDo {
+		err = p.errUnexpected("do")
+		return
+	}
+	p.consume()
+
+	body, err := p.parseStmtList(whileEndTokenMap)
+	if err != nil {
+		return
+	}
+	p.consume()
+
+	n = &WhileNode{Cond: cond, Body: body, Pos: pos}
+	return
+}
+
+var tryEndTokenMap = map[TokenType]bool{
+	TokenCatch:  true,
+	TokenEndTry: true,
+}
+
+var catchEndTokenMap = map[TokenType]bool{
+	TokenEndTry: true,
+}
+
+func (p *Parser) parseTry() (n Node, err error) {
+	t := p.getToken()
+	pos := p.pos(t)
+	p.consume()
+
+	body, err := p.parseStmtList(tryEndTokenMap)
+	if err != nil {
+		return
+	}
+	node := &TryNode{Body: body, Pos: pos}
+
+	if p.getToken().Type == TokenCatch {
+		p.consume()
+		t = p.getToken()
+		// in catch endtry the variable is missing
+		if !isIdent(t) || t.Type == TokenEndTry {
+			err = p.errUnexpected("identifier")
+			return
+		}
+		node.Var = string(t.Value)
+		p.consume()
+
+		node.Catch, err = p.parseStmtList(catchEndTokenMap)
+		if err != nil {
+			return
+		}
+	}
 	p.consume()
 
-	n = &ForNode{varName, expr, body}
+	n = node
 	return
 }
 
@@ -736,7 +1290,7 @@ func (p *Parser) parseDeclare() (n Node, err error) {
 	p.consume()
 
 	t = p.getToken()
-	if t.Type != TokenIdent {
+	if !isIdent(t) {
 		err = p.errUnexpected("identifier")
 		return
 	}
@@ -766,12 +1320,64 @@ func (p *Parser) parseDeclare() (n Node, err error) {
 	return
 }
 
+// parseAssign parses assign(name, expr) and set name = expr.
+func (p *Parser) parseAssign() (n Node, err error) {
+	t := p.getToken()
+	pos := p.pos(t)
+	set := t.Type == TokenSet
+	p.consume()
+
+	if !set {
+		if p.getToken().Type != TokenLeftParen {
+			err = p.errUnexpected("(")
+			return
+		}
+		p.consume()
+	}
+
+	t = p.getToken()
+	if !isIdent(t) {
+		err = p.errUnexpected("identifier")
+		return
+	}
+	name := string(t.Value)
+	p.consume()
+
+	if set {
+		if p.getToken().Type != TokenEquals {
+			err = p.errUnexpected("=")
+			return
+		}
+	} else if p.getToken().Type != TokenComma {
+		err = p.errUnexpected(",")
+		return
+	}
+	p.consume()
+
+	n, err = p.ParseExpr()
+	if err != nil {
+		return
+	}
+
+	if !set {
+		if p.getToken().Type != TokenRightParen {
+			err = p.errUnexpected(")")
+			return
+		}
+		p.consume()
+	}
+
+	n = &AssignNode{Name: name, Value: n, Pos: pos}
+	return
+}
+
 func (p *Parser) parseInclude() (n Node, err error) {
 	t := p.getToken()
 	if t.Type != TokenInclude {
 		err = p.errUnexpected("include")
 		return
 	}
+	pos := p.pos(t)
 	p.consume()
 
 	t = p.getToken()
@@ -793,7 +1399,7 @@ func (p *Parser) parseInclude() (n Node, err error) {
 	}
 	p.consume()
 
-	n = &IncludeNode{name}
+	n = &IncludeNode{Name: name, Pos: pos}
 	return
 }
 
@@ -819,6 +1425,96 @@ func (p *Parser) parseDiscard() (n Node, err error) {
 	return
 }
 
+// parseImport parses import name as m and from name import a, b
+func (p *Parser) parseImport() (n Node, err error) {
+	t := p.getToken()
+	if t.Type != TokenImport && t.Type != TokenFrom {
+		err = p.errUnexpected("import", "from")
+		return
+	}
+	from := t.Type == TokenFrom
+	pos := p.pos(t)
+	p.consume()
+
+	name, err := p.ParseExpr()
+	if err != nil {
+		return
+	}
+	node := &ImportNode{Name: name, Pos: pos}
+
+	if from {
+		t = p.getToken()
+		if t.Type != TokenImport {
+			err = p.errUnexpected("import")
+			return
+		}
+		p.consume()
+
+		for {
+			t = p.getToken()
+			if !isIdent(t) {
+				err = p.errUnexpected("identifier")
+				return
+			}
+			node.Names = append(node.Names, string(t.Value))
+			p.consume()
+
+			if p.getToken().Type != TokenComma {
+				break
+			}
+			p.consume()
+		}
+	} else {
+		t = p.getToken()
+		if t.Type != TokenAs {
+			err = p.errUnexpected("as")
+			return
+		}
+		p.consume()
+
+		t = p.getToken()
+		if !isIdent(t) {
+			err = p.errUnexpected("identifier")
+			return
+		}
+		node.As = string(t.Value)
+		p.consume()
+	}
+
+	n = node
+	return
+}
+
+func (p *Parser) parseExtends() (n Node, err error) {
+	t := p.getToken()
+	if t.Type != TokenExtends {
+		err = p.errUnexpected("extends")
+		return
+	}
+	pos := p.pos(t)
+	p.consume()
+
+	t = p.getToken()
+	if t.Type != TokenString {
+		err = p.errUnexpected("string")
+		return
+	}
+	p.consume()
+	subp := p.newSubParser(t)
+	name, err := subp.Parse()
+	if err != nil {
+		return
+	}
+	v, ok := name.(*ValueNode)
+	if !ok {
+		err = p.errorAt(t, "the parent template name must be static", "string")
+		return
+	}
+
+	n = &ExtendsNode{Template: v.Value, Pos: pos}
+	return
+}
+
 func (p *Parser) ParseStmt() (n Node, err error) {
 	t := p.getToken()
 	switch t.Type {
@@ -829,8 +1525,28 @@ func (p *Parser) ParseStmt() (n Node, err error) {
 		n, err = p.parseBlock()
 	case TokenDeclare:
 		n, err = p.parseDeclare()
+	case TokenAssign, TokenSet:
+		n, err = p.parseAssign()
 	case TokenDiscard:
 		n, err = p.parseDiscard()
+	case TokenExtends:
+		n, err = p.parseExtends()
+	case TokenImport, TokenFrom:
+		n, err = p.parseImport()
+	case TokenBreak:
+		p.consume()
+		n = &BreakNode{}
+	case TokenContinue:
+		p.consume()
+		n = &ContinueNode{}
+	case TokenReturn:
+		p.consume()
+		var value Node
+		value, err = p.ParseExpr()
+		if err != nil {
+			return
+		}
+		n = &ReturnNode{Value: value, Pos: p.pos(t)}
 	default:
 		n, err = p.ParseExpr()
 	}
@@ -853,7 +1569,8 @@ func (p *Parser) parseStmtList(endTokenMap map[TokenType]bool) (stmts []Node, er
 					expected = append(expected, strings.ToLower(tt.String()))
 				}
 			}
-			err = p.errUnexpected(strings.Join(expected, " | "))
+			sort.Strings(expected)
+			err = p.errUnexpected(expected...)
 			return
 		case TokenError:
 			err = p.s.Err
@@ -901,6 +1618,13 @@ type loopJump struct {
 	kind int
 }
 
+type loopScope struct {
+	jumps   *[]loopJump
+	scopes  int
+	filters int
+	signal  bool // the body of a try, which is left with a loopSignal
+}
+
 const (
 	loopJumpNext = iota
 	loopJumpEnd
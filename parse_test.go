@@ -0,0 +1,96 @@
+package tplexpr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	type testCase struct {
+		input  string
+		line   int
+		column int
+		token  string
+	}
+
+	testCases := []testCase{
+		{"Hello ${)}", 1, 9, ")"},
+		{"Hello\nWorld ${a +}", 2, 13, ""},
+		{"Line 1\nLine 2\n${if a then\n  x\n", 5, 1, ""},
+		{"${declare(x 1)}", 1, 13, "1"},
+		{"${\"Hello ${a +\"}", 1, 15, ""},
+		{"${'unterminated}", 1, 3, ""},
+		{"${a & b}", 1, 5, "&"},
+		{"${\"\\n${a & b}\"}", 1, 10, "&"},
+		{"${'\\'${a +}'}", 1, 12, ""},
+		{"${'\\\\' + 'x${a ä}'}", 1, 16, "ä"},
+		{"${a + !}", 1, 9, ""},
+		{"${a ? b}", 1, 5, "?"},
+		{"${a not in}", 1, 12, ""},
+		{"${a |> }", 1, 9, ""},
+		{"${set x 1}", 1, 9, "1"},
+		{"${assign(x = 1)}", 1, 12, "="},
+		{"${while x endwhile}", 1, 11, "endwhile"},
+		{"${a?.(b)}", 1, 6, "("},
+		{"${[1, 2}", 1, 9, ""},
+		{"${{a 1}}", 1, 6, "1"},
+		{"${{1: a}}", 1, 4, "1"},
+		{"${xs[1 2]}", 1, 8, "2"},
+		{"${for k, in o do k endfor}", 1, 10, "in"},
+		{"${for x in xs do else x else endfor}", 1, 25, "else"},
+		{"${extends base}", 1, 11, "base"},
+		{"${import 'a' b}", 1, 14, "b"},
+		{"${from 'a' import}", 1, 19, ""},
+		{"${extends 'base$x'}", 1, 11, "'base$x'"},
+		{"${block(f, a = 1, b)}", 1, 19, "b"},
+		{"${block(f, ...r, a)}", 1, 18, "a"},
+		{"${(**k, a) => \"\"}", 1, 9, "a"},
+		{"${f(a => 1, 2)}", 1, 13, "2"},
+		{"${(a) => a}", 1, 10, "a"},
+		{"${(a) => do return a}", 1, 22, ""},
+		{"${block(f)}${return}${endblock}", 1, 23, "endblock"},
+		{"${try x catch endtry}", 1, 15, "endtry"},
+		{"${try x catch e}", 1, 17, ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Logf("Parse %q", testCase.input)
+
+		p := NewParser([]byte(testCase.input))
+		_, err := p.Parse()
+		if err == nil {
+			t.Error("expected an error")
+			continue
+		}
+		if !errors.Is(err, ErrSyntax) {
+			t.Errorf("expected ErrSyntax, got %v", err)
+		}
+
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("expected a *ParseError, got %T", err)
+			continue
+		}
+		if pe.Line != testCase.line || pe.Column != testCase.column || pe.Token != testCase.token {
+			t.Errorf("expected %d:%d %q, got %d:%d %q (%v)",
+				testCase.line, testCase.column, testCase.token,
+				pe.Line, pe.Column, pe.Token, err)
+		}
+	}
+}
+
+func TestParseErrorTemplateName(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("broken.txt", []byte("ok\n${for x in xs do x}"))
+
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a *ParseError, got %v", err)
+	}
+	if pe.Template != "broken.txt" || pe.Line != 2 {
+		t.Errorf("unexpected error position %s", err)
+	}
+	if len(pe.Expected) != 2 || pe.Expected[0] != "else" || pe.Expected[1] != "endfor" {
+		t.Errorf("unexpected expected set %v", pe.Expected)
+	}
+}
@@ -1,8 +1,10 @@
 package tplexpr
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -329,6 +331,7 @@ func (o *reflectObject) Keys() []string {
 	for key := range keys {
 		keyList = append(keyList, key)
 	}
+	sort.Strings(keyList)
 
 	return keyList
 }
@@ -341,13 +344,30 @@ func (o *reflectObject) SetKey(name string, value Value) {
 }
 
 type reflectChanIter struct {
-	ch reflect.Value
+	ch  reflect.Value
+	ctx context.Context
 }
 
 var _ ValueIter = reflectChanIter{}
 
 func (i reflectChanIter) Next() (v Value, err error) {
-	rcv, ok := i.ch.Recv()
+	var (
+		rcv reflect.Value
+		ok  bool
+	)
+	if done := i.ctx.Done(); done != nil {
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: i.ch},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+		}
+		chosen := 0
+		chosen, rcv, ok = reflect.Select(cases)
+		if chosen == 1 {
+			return nil, i.ctx.Err()
+		}
+	} else {
+		rcv, ok = i.ch.Recv()
+	}
 	if !ok {
 		err = ErrIterExhausted
 	}
@@ -390,7 +410,11 @@ func (v reflectChan) List() ([]Value, error) {
 }
 
 func (v reflectChan) Iter() (ValueIter, error) {
-	return reflectChanIter{v.rv}, nil
+	return v.IterContext(context.Background())
+}
+
+func (v reflectChan) IterContext(ctx context.Context) (ValueIter, error) {
+	return reflectChanIter{v.rv, ctx}, nil
 }
 
 func (v reflectChan) Object() (Object, error) {
@@ -3,7 +3,10 @@ package tplexpr
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 //go:generate go run golang.org/x/tools/cmd/stringer -type TokenType -trimprefix Token
@@ -50,6 +53,34 @@ const (
 	TokenDiscard
 	TokenEndDiscard
 	TokenObject
+	TokenLeftBracket
+	TokenRightBracket
+	TokenLeftBrace
+	TokenRightBrace
+	TokenColon
+	TokenNOT
+	TokenMOD
+	TokenFLOORDIV
+	TokenPOW
+	TokenCoalesce
+	TokenOptionalDot
+	TokenNot
+	TokenPipe
+	TokenAssign
+	TokenSet
+	TokenEquals
+	TokenWhile
+	TokenEndWhile
+	TokenExtends
+	TokenImport
+	TokenFrom
+	TokenAs
+	TokenEllipsis
+	TokenReturn
+	TokenEnd
+	TokenTry
+	TokenCatch
+	TokenEndTry
 	TokenError
 )
 
@@ -85,17 +116,87 @@ var keywordMap = map[string]TokenType{
 	"discard":    TokenDiscard,
 	"enddiscard": TokenEndDiscard,
 	"object":     TokenObject,
+	"not":        TokenNot,
+	"assign":     TokenAssign,
+	"set":        TokenSet,
+	"while":      TokenWhile,
+	"endwhile":   TokenEndWhile,
+	"extends":    TokenExtends,
+	"import":     TokenImport,
+	"from":       TokenFrom,
+	"as":         TokenAs,
+	"return":     TokenReturn,
+	"end":        TokenEnd,
+	"try":        TokenTry,
+	"catch":      TokenCatch,
+	"endtry":     TokenEndTry,
 }
 
 var (
 	ErrSyntax = errors.New("syntax error")
 )
 
+// Pos is a 1-based line and column position in a template source.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// ParseError is returned by the Scanner and the Parser if the input is not
+// a valid template. It wraps ErrSyntax.
+type ParseError struct {
+	Template string
+	Line     int
+	Column   int
+	Token    string
+	Expected []string
+	Msg      string
+}
+
+func (e *ParseError) Error() string {
+	sb := strings.Builder{}
+	if e.Template != "" {
+		sb.WriteString(e.Template)
+		sb.WriteByte(':')
+	}
+	fmt.Fprintf(&sb, "%d:%d: %s: %s", e.Line, e.Column, ErrSyntax, e.Msg)
+	if len(e.Expected) > 0 {
+		sb.WriteString(", expected ")
+		sb.WriteString(strings.Join(e.Expected, " | "))
+	}
+	return sb.String()
+}
+
+func (e *ParseError) Unwrap() error {
+	return ErrSyntax
+}
+
+// setTemplateName sets the template name of err if it is a ParseError that
+// does not know its template yet.
+func setTemplateName(err error, name string) error {
+	var pe *ParseError
+	if errors.As(err, &pe) && pe.Template == "" {
+		pe.Template = name
+	}
+	return err
+}
+
 type Scanner struct {
-	Err   error
-	mode  int
-	pos   int
-	input []byte
+	Err    error
+	mode   int
+	pos    int
+	braces int // open braces of object literals in the expression
+	input  []byte
+	lines  []int
+
+	// a scanner for a string literal maps its offsets to positions in the
+	// raw literal of the parent scanner
+	parent  *Scanner
+	offsets []int
 }
 
 func NewScanner(input []byte) Scanner {
@@ -104,6 +205,64 @@ func NewScanner(input []byte) Scanner {
 	}
 }
 
+// newSubScanner creates a scanner for the value of the string literal t
+// that was scanned by parent.
+func newSubScanner(parent *Scanner, t Token) Scanner {
+	// escape sequences take two bytes in the raw literal but one in the
+	// value, so record the raw offset of every value byte
+	raw := parent.input[t.Start+1 : t.End-1]
+	offsets := make([]int, 0, len(t.Value)+1)
+	for i := 0; i < len(raw); i++ {
+		offsets = append(offsets, t.Start+1+i)
+		if raw[i] == '\\' {
+			i++
+		}
+	}
+	offsets = append(offsets, t.End-1)
+
+	return Scanner{
+		input:   t.Value,
+		parent:  parent,
+		offsets: offsets,
+	}
+}
+
+// position returns the line and column of the byte at offset.
+func (s *Scanner) position(offset int) Pos {
+	if s.parent != nil {
+		if offset >= len(s.offsets) {
+			offset = len(s.offsets) - 1
+		}
+		return s.parent.position(s.offsets[offset])
+	}
+
+	if s.lines == nil {
+		s.lines = []int{}
+		for i, c := range s.input {
+			if c == '\n' {
+				s.lines = append(s.lines, i)
+			}
+		}
+	}
+
+	// number of line breaks before offset
+	line := sort.SearchInts(s.lines, offset)
+	if line == 0 {
+		return Pos{1, 1 + offset}
+	}
+	return Pos{1 + line, offset - s.lines[line-1]}
+}
+
+func (s *Scanner) errorAt(offset int, token string, msg string) error {
+	pos := s.position(offset)
+	return &ParseError{
+		Line:   pos.Line,
+		Column: pos.Column,
+		Token:  token,
+		Msg:    msg,
+	}
+}
+
 func (s *Scanner) Scan() (t Token) {
 beginScan:
 	switch s.mode {
@@ -127,7 +286,7 @@ beginScan:
 
 				if wasDollar {
 					t.Type = TokenError
-					s.Err = fmt.Errorf("%w: Endingh with $", ErrSyntax)
+					s.Err = s.errorAt(s.pos-1, "$", "template ends with $")
 				}
 				return
 			}
@@ -156,7 +315,7 @@ beginScan:
 				default:
 					t.Type = TokenError
 					t.End = s.pos
-					s.Err = fmt.Errorf("%w: unexpected char after $", ErrSyntax)
+					s.Err = s.errorAt(s.pos, string(c), "unexpected char after $")
 					return
 				}
 			} else {
@@ -184,7 +343,7 @@ beginScan:
 		if s.pos >= len(s.input) {
 			t.Type = TokenError
 			t.End = s.pos
-			s.Err = fmt.Errorf("%w: EOF in expression", ErrSyntax)
+			s.Err = s.errorAt(s.pos, "", "EOF in expression")
 			return
 		}
 
@@ -192,8 +351,35 @@ beginScan:
 		switch c {
 		case '}':
 			s.pos += 1
+			if s.braces > 0 {
+				s.braces--
+				t.End = s.pos
+				t.Type = TokenRightBrace
+				return
+			}
 			s.mode = scanValue
 			goto beginScan
+		case '{':
+			s.pos += 1
+			s.braces++
+			t.End = s.pos
+			t.Type = TokenLeftBrace
+			return
+		case '[':
+			s.pos += 1
+			t.End = s.pos
+			t.Type = TokenLeftBracket
+			return
+		case ']':
+			s.pos += 1
+			t.End = s.pos
+			t.Type = TokenRightBracket
+			return
+		case ':':
+			s.pos += 1
+			t.End = s.pos
+			t.Type = TokenColon
+			return
 
 		case '%':
 			if s.pos+1 < len(s.input) && s.input[s.pos+1] == '}' {
@@ -205,9 +391,9 @@ beginScan:
 				}
 				goto beginScan
 			}
+			s.pos += 1
 			t.End = s.pos
-			t.Type = TokenError
-			s.Err = s.errUnexpectedInput()
+			t.Type = TokenMOD
 			return
 		case '(':
 			s.pos += 1
@@ -220,6 +406,12 @@ beginScan:
 			t.Type = TokenRightParen
 			return
 		case '.':
+			if s.pos+2 < len(s.input) && s.input[s.pos+1] == '.' && s.input[s.pos+2] == '.' {
+				s.pos += 3
+				t.End = s.pos
+				t.Type = TokenEllipsis
+				return
+			}
 			s.pos += 1
 			t.End = s.pos
 			t.Type = TokenDot
@@ -245,17 +437,17 @@ beginScan:
 				return
 			}
 
+			s.pos += 1
 			t.End = s.pos
-			t.Type = TokenError
-			s.Err = s.errUnexpectedInput()
+			t.Type = TokenEquals
 			return
 		case '>':
 			if s.pos+1 < len(s.input) && s.input[s.pos+1] == '=' {
 				s.pos += 2
-				t.Type = TokenGT
+				t.Type = TokenGE
 			} else {
 				s.pos += 1
-				t.Type = TokenGE
+				t.Type = TokenGT
 			}
 			t.End = s.pos
 			return
@@ -272,9 +464,27 @@ beginScan:
 		case '!':
 			if s.pos+1 < len(s.input) && s.input[s.pos+1] == '=' {
 				s.pos += 2
-				t.End = s.pos
 				t.Type = TokenNE
-				return
+			} else {
+				s.pos += 1
+				t.Type = TokenNOT
+			}
+			t.End = s.pos
+			return
+		case '?':
+			if s.pos+1 < len(s.input) {
+				switch s.input[s.pos+1] {
+				case '?':
+					s.pos += 2
+					t.End = s.pos
+					t.Type = TokenCoalesce
+					return
+				case '.':
+					s.pos += 2
+					t.End = s.pos
+					t.Type = TokenOptionalDot
+					return
+				}
 			}
 			t.End = s.pos
 			t.Type = TokenError
@@ -298,37 +508,45 @@ beginScan:
 				t.Type = TokenOR
 				return
 			}
+			if s.pos+1 < len(s.input) && s.input[s.pos+1] == '>' {
+				s.pos += 2
+				t.End = s.pos
+				t.Type = TokenPipe
+				return
+			}
 			t.End = s.pos
 			t.Type = TokenError
 			s.Err = s.errUnexpectedInput()
 			return
 		case '+':
-			if s.pos+1 < len(s.input) && unicode.IsDigit(rune(s.input[s.pos+1])) {
-				s.tryScanNumber(c, &t) // must succeed
-				return
-			}
 			s.pos += 1
 			t.End = s.pos
 			t.Type = TokenADD
 			return
 		case '-':
-			if s.pos+1 < len(s.input) && unicode.IsDigit(rune(s.input[s.pos+1])) {
-				s.tryScanNumber(c, &t) // must succeed
-				return
-			}
 			s.pos += 1
 			t.End = s.pos
 			t.Type = TokenSUB
 			return
 		case '*':
-			s.pos += 1
+			if s.pos+1 < len(s.input) && s.input[s.pos+1] == '*' {
+				s.pos += 2
+				t.Type = TokenPOW
+			} else {
+				s.pos += 1
+				t.Type = TokenMUL
+			}
 			t.End = s.pos
-			t.Type = TokenMUL
 			return
 		case '/':
-			s.pos += 1
+			if s.pos+1 < len(s.input) && s.input[s.pos+1] == '/' {
+				s.pos += 2
+				t.Type = TokenFLOORDIV
+			} else {
+				s.pos += 1
+				t.Type = TokenDIV
+			}
 			t.End = s.pos
-			t.Type = TokenDIV
 			return
 		case '"', '\'':
 			s.pos += 1
@@ -340,7 +558,7 @@ beginScan:
 				if s.pos >= len(s.input) {
 					t.End = s.pos
 					t.Type = TokenError
-					s.Err = fmt.Errorf("%w: EOF in string literal", ErrSyntax)
+					s.Err = s.errorAt(t.Start, "", "EOF in string literal")
 					return
 				}
 
@@ -364,7 +582,7 @@ beginScan:
 					default:
 						t.End = s.pos
 						t.Type = TokenError
-						s.Err = fmt.Errorf("%w: bad escape sequence (%c)", ErrSyntax, c)
+						s.Err = s.errorAt(s.pos-1, string([]byte{'\\', c}), fmt.Sprintf("bad escape sequence (%c)", c))
 						return
 					}
 				} else {
@@ -443,7 +661,7 @@ func (s *Scanner) tryScanNumber(startByte byte, t *Token) bool {
 	var value []byte
 
 	switch {
-	case startByte >= '0' && startByte <= '9', startByte == '+', startByte == '-':
+	case startByte >= '0' && startByte <= '9':
 		value = append(value, startByte)
 		s.pos += 1
 	default:
@@ -454,7 +672,15 @@ scan:
 	for s.pos < len(s.input) {
 		c := s.input[s.pos]
 		switch {
-		case c >= '0' && c <= '9', c == '+', c == '-', c == 'e', c == 'E':
+		case c >= '0' && c <= '9', c == 'e', c == 'E':
+			value = append(value, c)
+			s.pos += 1
+		case c == '+', c == '-':
+			// sign of the exponent
+			last := value[len(value)-1]
+			if last != 'e' && last != 'E' {
+				break scan
+			}
 			value = append(value, c)
 			s.pos += 1
 		case c == '.':
@@ -481,7 +707,9 @@ scan:
 }
 
 func (s *Scanner) errUnexpectedInput() error {
-	return fmt.Errorf("%w: unexpected input: %.5s", ErrSyntax, s.input[s.pos:])
+	_, size := utf8.DecodeRune(s.input[s.pos:])
+	token := string(s.input[s.pos : s.pos+size])
+	return s.errorAt(s.pos, token, fmt.Sprintf("unexpected input %q", token))
 }
 
 func isIdentByte(c byte) bool {
@@ -19,6 +19,13 @@ func TestScanType(t *testing.T) {
 		{`${Hello "World"}`, []TokenType{TokenIdent, TokenString, TokenEOF}},
 		{`$v."$it"`, []TokenType{TokenIdent, TokenValue, TokenIdent, TokenValue, TokenEOF}},
 		{`${v."$it"}`, []TokenType{TokenIdent, TokenDot, TokenString, TokenEOF}},
+		{`${[a]}`, []TokenType{TokenLeftBracket, TokenIdent, TokenRightBracket, TokenEOF}},
+		{`${a?.b ?? c}`, []TokenType{TokenIdent, TokenOptionalDot, TokenIdent, TokenCoalesce, TokenIdent, TokenEOF}},
+		{`${a |> b || c}`, []TokenType{TokenIdent, TokenPipe, TokenIdent, TokenOR, TokenIdent, TokenEOF}},
+		{`${1-2e-1 !x % 2 // 3 ** 4}`, []TokenType{TokenNumber, TokenSUB, TokenNumber, TokenNOT, TokenIdent, TokenMOD, TokenNumber, TokenFLOORDIV, TokenNumber, TokenPOW, TokenNumber, TokenEOF}},
+		{`${(a, ...b, **c) => ""}`, []TokenType{TokenLeftParen, TokenIdent, TokenComma, TokenEllipsis, TokenIdent, TokenComma, TokenPOW, TokenIdent, TokenRightParen, TokenArrow, TokenString, TokenEOF}},
+		{`${a > b >= c < d <= e}`, []TokenType{TokenIdent, TokenGT, TokenIdent, TokenGE, TokenIdent, TokenLT, TokenIdent, TokenLE, TokenIdent, TokenEOF}},
+		{`${{a: {}}}!`, []TokenType{TokenLeftBrace, TokenIdent, TokenColon, TokenLeftBrace, TokenRightBrace, TokenRightBrace, TokenValue, TokenEOF}},
 	}
 
 	for _, testCase := range testCases {
@@ -0,0 +1,205 @@
+package tplexpr
+
+// frameScope tracks the local variables of a frame during compilation.
+// Locals are declared in nested scopes, by for loops and as subprog
+// arguments. They live in the slots of the frame and are resolved at
+// compile time. The top level of a template has no locals: declarations
+// there are dynamic, so they are visible to included templates and to the
+// including template.
+type frameScope struct {
+	parent   *frameScope
+	template bool
+	locals   []string // the name of the local in each slot in use
+	scopes   []int    // len(locals) at the start of each open scope
+	size     int
+	captures []capture
+}
+
+// capture is a local of an enclosing frame that is used by a subprog. It
+// is copied when the subprog value is created.
+type capture struct {
+	name string
+	from int // see frameScope.resolve
+}
+
+func (f *frameScope) beginScope() {
+	f.scopes = append(f.scopes, len(f.locals))
+}
+
+func (f *frameScope) endScope() {
+	f.locals = f.locals[:f.scopes[len(f.scopes)-1]]
+	f.scopes = f.scopes[:len(f.scopes)-1]
+}
+
+// declared reports whether name is declared in the innermost scope.
+func (f *frameScope) declared(name string) bool {
+	start := 0
+	if len(f.scopes) > 0 {
+		start = f.scopes[len(f.scopes)-1]
+	}
+	for i := len(f.locals) - 1; i >= start; i-- {
+		if f.locals[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dynamic reports whether declarations are dynamic.
+func (f *frameScope) dynamic() bool {
+	return f.template && len(f.scopes) == 0
+}
+
+func (f *frameScope) push(name string) int {
+	f.locals = append(f.locals, name)
+	f.size = max(f.size, len(f.locals))
+	return len(f.locals) - 1
+}
+
+// declare returns the slot of the local name in the innermost scope. A
+// local declared twice in the same scope keeps its slot.
+func (f *frameScope) declare(name string) int {
+	if f.declared(name) {
+		idx, _ := f.resolve(name)
+		return idx
+	}
+	return f.push(name)
+}
+
+// local returns the slot of name if it is a local of f itself.
+func (f *frameScope) local(name string) (idx int, ok bool) {
+	for i := len(f.locals) - 1; i >= 0; i-- {
+		if f.locals[i] == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// resolve returns the slot (>= 0) or the capture (-1 for the first
+// capture, -2 for the second, ...) of the local name. Locals of enclosing
+// frames are captured on first use. ok is false if name is not a local
+// and has to be looked up dynamically.
+func (f *frameScope) resolve(name string) (idx int, ok bool) {
+	if idx, ok := f.local(name); ok {
+		return idx, true
+	}
+	for i, c := range f.captures {
+		if c.name == name {
+			return -i - 1, true
+		}
+	}
+	if f.parent == nil {
+		return 0, false
+	}
+	from, ok := f.parent.resolve(name)
+	if !ok {
+		return 0, false
+	}
+	f.captures = append(f.captures, capture{name, from})
+	return -len(f.captures), true
+}
+
+// visible returns the names of all locals that are visible in f,
+// including the ones of enclosing frames.
+func (f *frameScope) visible() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for ; f != nil; f = f.parent {
+		for i := len(f.locals) - 1; i >= 0; i-- {
+			if f.locals[i] != "" && !seen[f.locals[i]] {
+				seen[f.locals[i]] = true
+				names = append(names, f.locals[i])
+			}
+		}
+		for _, c := range f.captures {
+			if !seen[c.name] {
+				seen[c.name] = true
+				names = append(names, c.name)
+			}
+		}
+	}
+	return names
+}
+
+func (f *frameScope) captureSources() []int {
+	if len(f.captures) == 0 {
+		return nil
+	}
+	from := make([]int, len(f.captures))
+	for i, c := range f.captures {
+		from[i] = c.from
+	}
+	return from
+}
+
+// local returns the value of the slot (idx >= 0) or capture (idx < 0) of
+// the current frame, or nil if the local is not set.
+func (c *Context) local(idx int) Value {
+	if idx >= 0 {
+		if idx < len(c.frame) {
+			return c.frame[idx]
+		}
+	} else if -idx-1 < len(c.captures) {
+		return c.captures[-idx-1]
+	}
+	return nil
+}
+
+// lookupLocal returns the value of the local of instr. A local that is
+// not set yet is looked up by name (see CompileContext.hoistLocals).
+func (c *Context) lookupLocal(instr Instr) (Value, error) {
+	if v := c.local(instr.iarg); v != nil {
+		return v, nil
+	}
+	return c.Lookup(instr.sarg)
+}
+
+func (c *Context) setLocal(slot int, v Value) {
+	if slot >= len(c.frame) {
+		// only code that was not compiled as a template or subprog has
+		// no frame of the right size
+		frame := make([]Value, slot+1)
+		copy(frame, c.frame)
+		c.frame = frame
+	}
+	c.frame[slot] = v
+}
+
+// captureLocals copies the locals of the current frame that are captured
+// by a subprog.
+func (c *Context) captureLocals(from []int) []Value {
+	if len(from) == 0 {
+		return nil
+	}
+	captures := make([]Value, len(from))
+	for i, idx := range from {
+		captures[i] = c.local(idx)
+	}
+	return captures
+}
+
+type savedFrame struct {
+	frame    []Value
+	captures []Value
+	base     int
+}
+
+// pushFrame makes a new frame with the given number of slots and
+// captured values current. It returns the previous frame for popFrame.
+func (c *Context) pushFrame(slots int, captures []Value) savedFrame {
+	saved := savedFrame{c.frame, c.captures, len(c.slots)}
+	for i := 0; i < slots; i++ {
+		c.slots = append(c.slots, nil)
+	}
+	c.frame = c.slots[saved.base : saved.base+slots : saved.base+slots]
+	c.captures = captures
+	return saved
+}
+
+func (c *Context) popFrame(saved savedFrame) {
+	clear(c.slots[saved.base:])
+	c.slots = c.slots[:saved.base]
+	c.frame = saved.frame
+	c.captures = saved.captures
+}
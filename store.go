@@ -1,20 +1,91 @@
 package tplexpr
 
 import (
+	"bytes"
+	"context"
 	"io"
 	"io/fs"
 	"sync"
 	"time"
 )
 
+// contextPool hands out the Contexts used for a single render. They all
+// share the compiled program of the base Context, and the variables
+// declared in the base Context (by AddBuiltins or Plugin.InitContext) are
+// shared read-only as globals, so renders can run concurrently.
+type contextPool struct {
+	base Context
+	pool sync.Pool
+}
+
+func newContextPool(base *Context) *contextPool {
+	globals := make(map[string]Value, len(base.globals))
+	for e := base.env; e != nil; e = e.next {
+		if e.vars != nil {
+			for name, value := range e.vars {
+				if _, ok := globals[name]; !ok {
+					globals[name] = value
+				}
+			}
+		} else if _, ok := globals[e.name]; !ok {
+			globals[e.name] = e.value
+		}
+	}
+	for name, value := range base.globals {
+		if _, ok := globals[name]; !ok {
+			globals[name] = value
+		}
+	}
+
+	p := &contextPool{
+		base: Context{
+			globals:          globals,
+			subprogs:         base.subprogs,
+			valueFilters:     base.valueFilters,
+			templates:        base.templates,
+			NameError:        base.NameError,
+			TemplateNotFound: base.TemplateNotFound,
+			Limits:           base.Limits,
+		},
+	}
+	p.pool.New = func() any {
+		c := p.base
+		return &c
+	}
+	return p
+}
+
+func (p *contextPool) get() *Context {
+	return p.pool.Get().(*Context)
+}
+
+func (p *contextPool) put(c *Context) {
+	c.reset()
+	p.pool.Put(c)
+}
+
+func (p *contextPool) render(ctx context.Context, w io.Writer, name string, vars Vars) error {
+	c := p.get()
+	defer p.put(c)
+	return c.EvalTemplateWriterContext(ctx, name, vars, w)
+}
+
 type simpleStore struct {
-	c Context
+	pool *contextPool
 }
 
 var _ Store = &simpleStore{}
 
 func (s *simpleStore) Render(w io.Writer, name string, vars Vars) error {
-	return s.c.EvalTemplateWriter(name, vars, w)
+	return s.RenderContext(context.Background(), w, name, vars)
+}
+
+func (s *simpleStore) Disassemble(w io.Writer) error {
+	return s.pool.base.Disassemble(w)
+}
+
+func (s *simpleStore) RenderContext(ctx context.Context, w io.Writer, name string, vars Vars) error {
+	return s.pool.render(ctx, w, name, vars)
 }
 
 type watchFile struct {
@@ -27,10 +98,12 @@ type watchStore struct {
 	mux         sync.Mutex
 	plugins     []Plugin
 	files       []storeFS
+	bundles     [][]byte
 	parsed      bool
-	c           Context
+	pool        *contextPool
 	watchFiles  []watchFile
 	addBuiltins bool
+	limits      Limits
 }
 
 var _ Store = &watchStore{}
@@ -65,6 +138,13 @@ func (s *watchStore) parse() error {
 	cc := NewCompileContext()
 	s.watchFiles = s.watchFiles[:0]
 
+	for _, data := range s.bundles {
+		err := LoadBundle(bytes.NewReader(data), &cc)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, f := range s.files {
 		for _, glob := range f.globs {
 			matches, err := fs.Glob(f.fs, glob)
@@ -83,39 +163,59 @@ func (s *watchStore) parse() error {
 				}
 				err = s.parseTemplate(fileName, data, &cc)
 				if err != nil {
-					return err
+					return setTemplateName(err, fileName)
 				}
 				s.watchFiles = append(s.watchFiles, watchFile{f.fs, fileName, st.ModTime()})
 			}
 		}
 	}
 
-	s.parsed = true
-	_, s.c = cc.Compile()
+	err := cc.Link()
+	if err != nil {
+		return err
+	}
+	_, c := cc.Compile()
 	if s.addBuiltins {
-		AddBuiltins(&s.c)
+		AddBuiltins(&c)
 	}
 	for _, p := range s.plugins {
-		p.InitContext(&s.c)
+		p.InitContext(&c)
 	}
+	c.Limits = s.limits
+	s.pool = newContextPool(&c)
+	s.parsed = true
 	return nil
 }
 
-func (s *watchStore) updateWatchedFiles() error {
+func (s *watchStore) updateWatchedFiles() (*contextPool, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	if !s.parsed || s.isExpired() {
 		s.parsed = false
 		err := s.parse()
-		return err
+		if err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	return s.pool, nil
 }
 
 func (s *watchStore) Render(w io.Writer, name string, vars Vars) error {
-	err := s.updateWatchedFiles()
+	return s.RenderContext(context.Background(), w, name, vars)
+}
+
+func (s *watchStore) Disassemble(w io.Writer) error {
+	pool, err := s.updateWatchedFiles()
+	if err != nil {
+		return err
+	}
+	return pool.base.Disassemble(w)
+}
+
+func (s *watchStore) RenderContext(ctx context.Context, w io.Writer, name string, vars Vars) error {
+	pool, err := s.updateWatchedFiles()
 	if err != nil {
 		return err
 	}
-	return s.c.EvalTemplateWriter(name, vars, w)
+	return pool.render(ctx, w, name, vars)
 }
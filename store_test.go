@@ -1,10 +1,18 @@
 package tplexpr
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestStore(t *testing.T) {
@@ -84,3 +92,270 @@ func TestStoreWatch(t *testing.T) {
 		t.Errorf("expected '%s', found '%s'", expected, found)
 	}
 }
+
+func renderConcurrently(t *testing.T, store Store, expected map[string]string, vars Vars) {
+	const workers = 16
+	const iterations = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				for name, result := range expected {
+					sb := strings.Builder{}
+					err := store.Render(&sb, name, vars)
+					if err != nil {
+						t.Errorf("render %s: %v", name, err)
+						return
+					}
+					if sb.String() != result {
+						t.Errorf("render %s: expected %q, found %q", name, result, sb.String())
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func loadTestResults(t *testing.T, fsys fs.FS) map[string]string {
+	matches, err := fs.Glob(fsys, "*.test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{}
+	for _, fileName := range matches {
+		result, err := fs.ReadFile(fsys, strings.TrimSuffix(fileName, ".test.txt")+".result.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[fileName] = string(result)
+	}
+	return expected
+}
+
+func TestStoreConcurrentRender(t *testing.T) {
+	fsys := os.DirFS("testdata")
+	store, err := BuildStore().
+		AddFS(fsys, "*.test.txt", "*.template.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderConcurrently(t, store, loadTestResults(t, fsys), testFileVars().Build())
+}
+
+func TestStoreWatchConcurrentRender(t *testing.T) {
+	fsys := os.DirFS("testdata")
+	store, err := BuildStore().
+		AddFS(fsys, "*.test.txt", "*.template.txt").
+		Watch(true).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renderConcurrently(t, store, loadTestResults(t, fsys), testFileVars().Build())
+}
+
+func TestStoreConcurrentGlobals(t *testing.T) {
+	fsys := fstest.MapFS{
+		"count.txt": {Data: []byte(`${declare(sep, "") for i in range(n) do sep i declare(sep, ",") endfor}`)},
+	}
+	store, err := BuildStore().
+		AddFS(fsys, "*.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			expected := []string{}
+			for j := 0; j < n; j++ {
+				expected = append(expected, strconv.Itoa(j))
+			}
+			for j := 0; j < 50; j++ {
+				sb := strings.Builder{}
+				err := store.Render(&sb, "count.txt", BuildVars().SetNumber("n", float64(n)).Build())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if sb.String() != strings.Join(expected, ",") {
+					t.Errorf("expected %q, found %q", strings.Join(expected, ","), sb.String())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStoreRenderContext(t *testing.T) {
+	fsys := fstest.MapFS{
+		"range.txt": {Data: []byte(`${for i in range(1000000000000) do endfor}`)},
+		"chan.txt":  {Data: []byte(`${for x in ch do x endfor}`)},
+		"in.txt":    {Data: []byte(`${1 in ch}`)},
+		"max.txt":   {Data: []byte(`${max(range(1000000000000))}`)},
+		"func.txt":  {Data: []byte(`${wait()}`)},
+	}
+	store, err := BuildStore().
+		AddFS(fsys, "*.txt").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vars := BuildVars().
+		SetReflect("ch", make(chan int)).
+		Set("wait", FuncValue(func(args Args) (Value, error) {
+			<-args.Context().Done()
+			return nil, args.Context().Err()
+		})).
+		Build()
+
+	for _, name := range []string{"range.txt", "chan.txt", "in.txt", "max.txt", "func.txt"} {
+		t.Logf("Render %s", name)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := store.RenderContext(ctx, io.Discard, name, vars)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.RenderContext(ctx, io.Discard, "chan.txt", vars)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestStoreLimits(t *testing.T) {
+	fsys := fstest.MapFS{
+		"loop.txt":    {Data: []byte(`${for i in range(1000000000000) do endfor}`)},
+		"max.txt":     {Data: []byte(`${max(range(1000000000000))}`)},
+		"block.txt":   {Data: []byte(`${block(f, g)}${g(g)}${endblock f(f)}`)},
+		"include.txt": {Data: []byte(`${include('include.txt')}`)},
+		"output.txt":  {Data: []byte(`${for i in range(100) do 'hello world' endfor}`)},
+		"list.txt":    {Data: []byte(`${declare(l, list()) for i in range(100) do declare(l, append(l, i)) endfor}`)},
+		"string.txt":  {Data: []byte(`${declare(s, 'x') for i in range(20) do declare(s, s + s) endfor}`)},
+		"while.txt":   {Data: []byte(`${while true do endwhile}`)},
+		"ok.txt":      {Data: []byte(`${for i in range(10) do i endfor}`)},
+	}
+	store, err := BuildStore().
+		AddFS(fsys, "*.txt").
+		Limits(Limits{
+			MaxInstructions:    100000,
+			MaxCallDepth:       50,
+			MaxOutputBytes:     1000,
+			MaxListSize:        50,
+			MaxStringSize:      10000,
+			MaxWhileIterations: 1000,
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"loop.txt", "max.txt", "block.txt", "include.txt", "output.txt", "list.txt", "string.txt", "while.txt"} {
+		t.Logf("Render %s", name)
+		err := store.Render(io.Discard, name, nil)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("expected ErrLimitExceeded, got %v", err)
+		}
+	}
+
+	// the limits apply to each render on its own
+	for i := 0; i < 3; i++ {
+		sb := strings.Builder{}
+		err = store.Render(&sb, "ok.txt", nil)
+		if err != nil {
+			t.Error(err)
+		} else if sb.String() != "0123456789" {
+			t.Errorf("expected '0123456789', found '%s'", sb.String())
+		}
+	}
+}
+
+func TestWhileLimit(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("loop", []byte(`${declare(i, 0) while i < n do set i = i + 1 endwhile}$i`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := cc.Compile()
+	vars := Vars{"n": NumberValue(DefaultMaxWhileIterations + 1)}
+
+	// the default limit applies without configured limits
+	_, err = c.EvalTemplateString("loop", vars)
+	if !errors.Is(err, ErrLimitExceeded) || !strings.Contains(err.Error(), "while") {
+		t.Errorf("expected the while limit to be exceeded, got %v", err)
+	}
+
+	for _, max := range []int{DefaultMaxWhileIterations + 1, -1} {
+		c.Limits.MaxWhileIterations = max
+		sb := strings.Builder{}
+		err := c.EvalTemplateWriter("loop", vars, &sb)
+		if err != nil {
+			t.Error(err)
+		} else if sb.String() != strconv.Itoa(DefaultMaxWhileIterations+1) {
+			t.Errorf("unexpected result %s", sb.String())
+		}
+	}
+}
+
+func TestContextLimits(t *testing.T) {
+	cc := NewCompileContext()
+	err := cc.ParseTemplate("loop", []byte(`${for i in range(1000) do i endfor}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c := cc.Compile()
+	AddBuiltins(&c)
+	c.Limits.MaxOutputBytes = 10
+
+	err = c.EvalTemplateWriter("loop", nil, io.Discard)
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded, got %v", err)
+	}
+}
+
+func TestBuildLimits(t *testing.T) {
+	// without an instruction limit, lists and strings must be checked
+	// while they are built
+	for _, input := range []string{
+		`${toList(range(1000000000000))}`,
+		`${list(1, 2, 3, 4)}`,
+		`${[1, 2, 3, 4]}`,
+		`${range(1000000000000)[0:2]}`,
+		`${reversed(map(range(1000000000000)))}`,
+		`${append([1, 2, 3], 4)}`,
+		`${[1, 2, 3] + 4}`,
+		`${join(['xxx', 'xxx', 'xxx'], '')}`,
+		`${'xxxxx' + 'xxxxx'}`,
+	} {
+		cc := NewCompileContext()
+		err := cc.ParseTemplate("main", []byte(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, c := cc.Compile()
+		AddBuiltins(&c)
+		c.Limits = Limits{MaxListSize: 3, MaxStringSize: 8}
+
+		err = c.EvalTemplateWriter("main", nil, io.Discard)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s: expected ErrLimitExceeded, got %v", input, err)
+		}
+	}
+}
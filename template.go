@@ -1,13 +1,24 @@
 package tplexpr
 
 import (
+	"context"
 	"io"
 )
 
 type Template struct {
-	Code []Instr
+	Code    []Instr
+	Slots   int            // size of the frame
+	Extends string         // the parent template
+	Blocks  map[string]int // subprogs of the blocks declared at the top level
 }
 
+// A Store renders compiled templates. It is safe for concurrent use.
 type Store interface {
 	Render(w io.Writer, name string, vars Vars) error
+	// RenderContext is like Render, but stops rendering with the error of
+	// ctx once ctx is done.
+	RenderContext(ctx context.Context, w io.Writer, name string, vars Vars) error
+	// Disassemble writes a listing of the compiled templates to w. It is
+	// meant for debugging.
+	Disassemble(w io.Writer) error
 }
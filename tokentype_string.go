@@ -48,12 +48,40 @@ func _() {
 	_ = x[TokenDiscard-37]
 	_ = x[TokenEndDiscard-38]
 	_ = x[TokenObject-39]
-	_ = x[TokenError-40]
+	_ = x[TokenLeftBracket-40]
+	_ = x[TokenRightBracket-41]
+	_ = x[TokenLeftBrace-42]
+	_ = x[TokenRightBrace-43]
+	_ = x[TokenColon-44]
+	_ = x[TokenNOT-45]
+	_ = x[TokenMOD-46]
+	_ = x[TokenFLOORDIV-47]
+	_ = x[TokenPOW-48]
+	_ = x[TokenCoalesce-49]
+	_ = x[TokenOptionalDot-50]
+	_ = x[TokenNot-51]
+	_ = x[TokenPipe-52]
+	_ = x[TokenAssign-53]
+	_ = x[TokenSet-54]
+	_ = x[TokenEquals-55]
+	_ = x[TokenWhile-56]
+	_ = x[TokenEndWhile-57]
+	_ = x[TokenExtends-58]
+	_ = x[TokenImport-59]
+	_ = x[TokenFrom-60]
+	_ = x[TokenAs-61]
+	_ = x[TokenEllipsis-62]
+	_ = x[TokenReturn-63]
+	_ = x[TokenEnd-64]
+	_ = x[TokenTry-65]
+	_ = x[TokenCatch-66]
+	_ = x[TokenEndTry-67]
+	_ = x[TokenError-68]
 }
 
-const _TokenType_name = "ValueIdentNumberLeftParenRightParenDotCommaEOFStringArrowDeclareGTGEEQNELELTANDORADDSUBMULDIVBlockEndBlockIfThenElseElseIfEndIfForInDoBreakContinueEndForIncludeDiscardEndDiscardObjectError"
+const _TokenType_name = "ValueIdentNumberLeftParenRightParenDotCommaEOFStringArrowDeclareGTGEEQNELELTANDORADDSUBMULDIVBlockEndBlockIfThenElseElseIfEndIfForInDoBreakContinueEndForIncludeDiscardEndDiscardObjectLeftBracketRightBracketLeftBraceRightBraceColonNOTMODFLOORDIVPOWCoalesceOptionalDotNotPipeAssignSetEqualsWhileEndWhileExtendsImportFromAsEllipsisReturnEndTryCatchEndTryError"
 
-var _TokenType_index = [...]uint8{0, 5, 10, 16, 25, 35, 38, 43, 46, 52, 57, 64, 66, 68, 70, 72, 74, 76, 79, 81, 84, 87, 90, 93, 98, 106, 108, 112, 116, 122, 127, 130, 132, 134, 139, 147, 153, 160, 167, 177, 183, 188}
+var _TokenType_index = [...]uint16{0, 5, 10, 16, 25, 35, 38, 43, 46, 52, 57, 64, 66, 68, 70, 72, 74, 76, 79, 81, 84, 87, 90, 93, 98, 106, 108, 112, 116, 122, 127, 130, 132, 134, 139, 147, 153, 160, 167, 177, 183, 194, 206, 215, 225, 230, 233, 236, 244, 247, 255, 266, 269, 273, 279, 282, 288, 293, 301, 308, 314, 318, 320, 328, 334, 337, 340, 345, 351, 356}
 
 func (i TokenType) String() string {
 	if i < 0 || i >= TokenType(len(_TokenType_index)-1) {
@@ -1,8 +1,11 @@
 package tplexpr
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -83,6 +86,20 @@ type ValueIter interface {
 	Next() (Value, error)
 }
 
+// ContextIterable is implemented by values whose iterators may block,
+// like channels. IterContext returns an iterator that stops with the
+// error of ctx once ctx is done.
+type ContextIterable interface {
+	IterContext(ctx context.Context) (ValueIter, error)
+}
+
+func iterContext(ctx context.Context, v Value) (ValueIter, error) {
+	if it, ok := v.(ContextIterable); ok {
+		return it.IterContext(ctx)
+	}
+	return v.Iter()
+}
+
 type Object interface {
 	Key(name string) (Value, bool)
 	SetKey(name string, value Value)
@@ -106,10 +123,17 @@ func (m *MapObject) SetKey(name string, value Value) {
 }
 
 func (m *MapObject) Keys() []string {
-	keys := make([]string, 0, len(m.M))
-	for key := range m.M {
+	return sortedKeys(m.M)
+}
+
+// sortedKeys returns the keys of m in sorted order, so objects iterate
+// deterministically.
+func sortedKeys(m map[string]Value) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
 		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 	return keys
 }
 
@@ -119,9 +143,16 @@ const (
 	opSub     = "subtract"
 	opMul     = "multiply"
 	opDiv     = "divide"
+	opMod     = "take the modulo of"
+	opPow     = "raise"
+	opIndex   = "index"
+	opSlice   = "slice"
+	opSearch  = "search"
 	conTO     = "to"
 	conBY     = "by"
+	conFROM   = "from"
 	conOF     = "of"
+	conIN     = "in"
 )
 
 type ErrType struct {
@@ -132,7 +163,7 @@ type ErrType struct {
 }
 
 func (e *ErrType) Error() string {
-	return fmt.Sprintf("type error: can not %s %s to %s", e.Op, e.From, e.To)
+	return fmt.Sprintf("type error: can not %s %s %s %s", e.Op, e.From, e.con, e.To)
 }
 
 type nilValue struct{}
@@ -369,27 +400,16 @@ func (o ObjectValue) Number() (float64, error) {
 }
 
 func (o ObjectValue) String() (string, error) {
-	sb := strings.Builder{}
-	first := true
-	for key := range o {
-		if !first {
-			sb.WriteByte(' ')
-		} else {
-			first = false
-		}
-
-		sb.WriteString(key)
-	}
-
-	return sb.String(), nil
+	return strings.Join(sortedKeys(o), " "), nil
 }
 
 func (o ObjectValue) List() ([]Value, error) {
-	keys := make([]Value, 0, len(o))
-	for key := range o {
-		keys = append(keys, StringValue(key))
+	keys := sortedKeys(o)
+	values := make([]Value, len(keys))
+	for i := range keys {
+		values[i] = StringValue(keys[i])
 	}
-	return keys, nil
+	return values, nil
 }
 
 func (o ObjectValue) Iter() (ValueIter, error) {
@@ -453,14 +473,67 @@ func (f FuncValue) Object() (Object, error) {
 	return &MapObject{}, nil
 }
 
+// Call calls f with args. Named arguments are rejected with ErrArgUnknown,
+// use NamedFuncValue for a function that reads them.
 func (f FuncValue) Call(args Args, wr ValueWriter) error {
+	if len(args.named) > 0 {
+		return fmt.Errorf("%w '%s'", ErrArgUnknown, sortedKeys(args.named)[0])
+	}
+	return f.call(args, wr)
+}
+
+func (f FuncValue) call(args Args, wr ValueWriter) error {
 	value, err := f(args)
 	if err != nil {
 		return err
 	}
+	if args.exec != nil {
+		err = args.exec.checkValue(value)
+		if err != nil {
+			return err
+		}
+	}
 	return wr.WriteValue(value)
 }
 
+// NamedFuncValue is like FuncValue, but also accepts arguments passed as
+// name => value, which it reads with Args.Named.
+type NamedFuncValue func(args Args) (Value, error)
+
+var _ Value = NamedFuncValue(nil)
+
+func (f NamedFuncValue) Kind() ValueKind {
+	return KindFunction
+}
+
+func (f NamedFuncValue) Number() (float64, error) {
+	return FuncValue(f).Number()
+}
+
+func (f NamedFuncValue) Bool() bool {
+	return true
+}
+
+func (f NamedFuncValue) String() (string, error) {
+	return FuncValue(f).String()
+}
+
+func (f NamedFuncValue) List() ([]Value, error) {
+	return FuncValue(f).List()
+}
+
+func (f NamedFuncValue) Iter() (ValueIter, error) {
+	return FuncValue(f).Iter()
+}
+
+func (f NamedFuncValue) Object() (Object, error) {
+	return &MapObject{}, nil
+}
+
+func (f NamedFuncValue) Call(args Args, wr ValueWriter) error {
+	return FuncValue(f).call(args, wr)
+}
+
 var IterListLimit = 10000
 
 type IterValue struct {
@@ -542,35 +615,163 @@ func (v IterValue) Call(args Args, wr ValueWriter) error {
 	return wr.WriteValue(vv)
 }
 
+var (
+	ErrArgMissing   = errors.New("missing argument")
+	ErrArgDuplicate = errors.New("argument passed twice")
+	ErrArgUnknown   = errors.New("unexpected argument")
+)
+
 type subprogValue struct {
-	code []Instr
-	args []string
-	ctx  *Context
+	subprog  *Subprog
+	ctx      *Context
+	captures []Value
 }
 
 var _ Value = &subprogValue{}
 
+// returnSignal unwinds the evaluation of a subprog to its call for a
+// return statement.
+type returnSignal struct {
+	value Value
+}
+
+func (r *returnSignal) Error() string {
+	return "return outside of a subprog"
+}
+
 func (s *subprogValue) eval(args Args, wr ValueWriter) error {
+	if s.ctx.exec != nil {
+		err := s.ctx.exec.enter()
+		if err != nil {
+			return err
+		}
+		defer s.ctx.exec.leave()
+	}
+
 	ctx := s.ctx.Clone()
 	ctx.BeginScope()
 	defer ctx.EndScope()
 
-	for i, argName := range s.args {
-		ctx.Declare(argName, args.Get(i))
+	saved := ctx.pushFrame(s.subprog.Slots, s.captures)
+	defer ctx.popFrame(saved)
+	err := s.bindArgs(ctx, args)
+	if err == nil {
+		err = EvalRaw(ctx, s.subprog.Code, wr)
+	}
+	if ret, ok := err.(*returnSignal); ok {
+		// the returned value replaces what was written to a value
+		// builder, but not what was already rendered
+		if b, ok := wr.(*returnValueBuilder); ok {
+			*b = returnValueBuilder{}
+		}
+		return wr.WriteValue(ret.value)
+	}
+	if err != nil {
+		err = closeFrame(err, s.subprog.Template, s.subprog.Name)
+	}
+	return err
+}
+
+// bindArgs sets the parameters of the subprog in the frame pushed for it.
+// Extra positional args are ignored without a rest parameter. Missing args
+// are an error for calls in a template, builtins calling back and implicit
+// evaluation pass Nil instead.
+func (s *subprogValue) bindArgs(c *Context, args Args) error {
+	subprog := s.subprog
+	for i := range subprog.Args {
+		if i < len(args.args) {
+			c.frame[i] = args.args[i]
+		}
+	}
+
+	slot := len(subprog.Args)
+	if subprog.Rest != "" {
+		rest := ListValue{}
+		if len(args.args) > slot {
+			rest = append(rest, args.args[slot:]...)
+		}
+		c.frame[slot] = rest
+		slot++
+	}
+	var kwargs ObjectValue
+	if subprog.Kwargs != "" {
+		kwargs = ObjectValue{}
+		c.frame[slot] = kwargs
+	}
+
+	for _, name := range sortedKeys(args.named) {
+		i := slices.Index(subprog.Args, name)
+		switch {
+		case i >= 0 && c.frame[i] != nil:
+			return fmt.Errorf("%w '%s' of %s", ErrArgDuplicate, name, s.name())
+		case i >= 0:
+			c.frame[i] = args.named[name]
+		case kwargs != nil:
+			kwargs[name] = args.named[name]
+		default:
+			return fmt.Errorf("%w '%s' of %s", ErrArgUnknown, name, s.name())
+		}
 	}
 
-	return EvalRaw(ctx, s.code, wr)
+	required := len(subprog.Args) - len(subprog.Defaults)
+	for i, name := range subprog.Args {
+		if c.frame[i] != nil {
+			continue
+		}
+		if i < required {
+			if args.call {
+				return fmt.Errorf("%w '%s' of %s", ErrArgMissing, name, s.name())
+			}
+			c.frame[i] = Nil
+			continue
+		}
+		wr := returnValueBuilder{}
+		err := evalCallSubprogNA(c, Instr{iarg: subprog.Defaults[i-required]}, &wr)
+		if err != nil {
+			return err
+		}
+		c.frame[i] = wr.Value()
+	}
+	return nil
+}
+
+func (s *subprogValue) name() string {
+	if s.subprog.Name == "" {
+		return "lambda"
+	}
+	return s.subprog.Name
 }
 
 func (s *subprogValue) evalString(args Args) (string, error) {
+	if s.ctx.exec != nil {
+		err := s.ctx.exec.enter()
+		if err != nil {
+			return "", err
+		}
+		defer s.ctx.exec.leave()
+	}
+
 	s.ctx.BeginScope()
 	defer s.ctx.EndScope()
 
-	for i, argName := range s.args {
-		s.ctx.Declare(argName, args.Get(i))
+	saved := s.ctx.pushFrame(s.subprog.Slots, s.captures)
+	defer s.ctx.popFrame(saved)
+	iters := len(s.ctx.iters)
+	var str string
+	err := s.bindArgs(s.ctx, args)
+	if err == nil {
+		str, err = EvalString(s.ctx, s.subprog.Code)
 	}
-
-	return EvalString(s.ctx, s.code)
+	if ret, ok := err.(*returnSignal); ok {
+		// loops the return left are still open
+		clear(s.ctx.iters[iters:])
+		s.ctx.iters = s.ctx.iters[:iters]
+		return ret.value.String()
+	}
+	if err != nil {
+		err = closeFrame(err, s.subprog.Template, s.subprog.Name)
+	}
+	return str, err
 }
 
 func (s *subprogValue) Kind() ValueKind {
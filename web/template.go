@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -17,6 +18,10 @@ func NewStore(s tplexpr.Store, r ContentTypeResolver) *Store {
 }
 
 func (s *Store) Render(w http.ResponseWriter, status int, name string, vars tplexpr.Vars) error {
+	return s.RenderContext(context.Background(), w, status, name, vars)
+}
+
+func (s *Store) RenderContext(ctx context.Context, w http.ResponseWriter, status int, name string, vars tplexpr.Vars) error {
 	contentType := ""
 	ok := false
 	if s.r != nil {
@@ -28,7 +33,7 @@ func (s *Store) Render(w http.ResponseWriter, status int, name string, vars tple
 		w.Header().Set("Content-Type", contentType)
 	}
 	w.WriteHeader(status)
-	return s.s.Render(w, name, vars)
+	return s.s.RenderContext(ctx, w, name, vars)
 }
 
 type ContentTypeResolver interface {